@@ -7,9 +7,57 @@ CREATE TABLE IF NOT EXISTS pulse.checkin
     target_user String,
     target_topic String,
     value Int8,
-    timestamp DateTime
+    timestamp DateTime,
+    from_reply Bool DEFAULT false
   )
   Engine = MergeTree()
   PARTITION BY toYYYYMM(timestamp)
   ORDER BY (channel, timestamp)
   SETTINGS index_granularity = 8192;
+
+-- Added after launch, keep for existing deployments.
+ALTER TABLE pulse.checkin ADD COLUMN IF NOT EXISTS from_reply Bool DEFAULT false;
+
+-- Per-minute rollup of votes by target, used for candle charts.
+CREATE TABLE IF NOT EXISTS pulse.checkin_minute
+  (
+    channel String,
+    target_user String,
+    target_topic String,
+    minute DateTime,
+    delta Int64,
+    votes UInt64
+  )
+  Engine = SummingMergeTree()
+  PARTITION BY toYYYYMM(minute)
+  ORDER BY (channel, target_user, target_topic, minute)
+  SETTINGS index_granularity = 8192;
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS pulse.checkin_minute_mv
+  TO pulse.checkin_minute
+  AS SELECT
+    channel,
+    target_user,
+    lowerUTF8(normalizeUTF8NFC(target_topic)) AS target_topic,
+    toStartOfMinute(timestamp) AS minute,
+    toInt64(value) AS delta,
+    toUInt64(1) AS votes
+  FROM pulse.checkin;
+
+-- Existing deployments need a one time backfill after creating the view:
+--   INSERT INTO pulse.checkin_minute
+--   SELECT channel, target_user, lowerUTF8(normalizeUTF8NFC(target_topic)), toStartOfMinute(timestamp), toInt64(value), 1
+--   FROM pulse.checkin WHERE timestamp < <time the view was created>;
+
+-- Channels the bot joins, managed through the admin api. The latest row per
+-- login wins.
+CREATE TABLE IF NOT EXISTS pulse.channels
+  (
+    login String,
+    room_id String,
+    display_name String,
+    active Bool,
+    updated_at DateTime64(3)
+  )
+  Engine = ReplacingMergeTree(updated_at)
+  ORDER BY login;
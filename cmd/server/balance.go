@@ -0,0 +1,86 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
+)
+
+type balanceResponse struct {
+	Channel string `json:"channel"`
+	User    *User  `json:"user,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+	Balance
+}
+
+// BalanceHandler serves balances for users and topics in a channel.
+type BalanceHandler struct {
+	Store LedgerStore
+	Users *UserCache
+}
+
+// Streamer serves GET /balance/{id}, the channel owner's balance as a bare
+// number.
+func (h *BalanceHandler) Streamer(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+
+	b, err := h.Store.UserBalance(r.Context(), id, id)
+	if err != nil {
+		slog.Error("querying balance", "channel", id, "err", err)
+		writeError(w, http.StatusInternalServerError, "failed to load balance")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, b.Total)
+}
+
+// User serves GET /balance/{channel}/user/{login}.
+func (h *BalanceHandler) User(w http.ResponseWriter, r *http.Request) {
+	channel := r.PathValue("channel")
+	login := r.PathValue("login")
+
+	u, err := h.Users.GetByDisplayName(r.Context(), login)
+	if errors.Is(err, twclient.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "user not found")
+		return
+	}
+	if err != nil {
+		slog.Error("resolving user for balance", "login", login, "err", err)
+		writeError(w, http.StatusBadGateway, "failed to look up user")
+		return
+	}
+
+	b, err := h.Store.UserBalance(r.Context(), channel, u.ID)
+	if err != nil {
+		slog.Error("querying user balance", "channel", channel, "user", u.ID, "err", err)
+		writeError(w, http.StatusInternalServerError, "failed to load balance")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, balanceResponse{
+		Channel: channel,
+		User:    u,
+		Balance: *b,
+	})
+}
+
+// Topic serves GET /balance/{channel}/topic/{topic}.
+func (h *BalanceHandler) Topic(w http.ResponseWriter, r *http.Request) {
+	channel := r.PathValue("channel")
+	topic := normalizeName(r.PathValue("topic"))
+
+	b, err := h.Store.TopicBalance(r.Context(), channel, topic)
+	if err != nil {
+		slog.Error("querying topic balance", "channel", channel, "topic", topic, "err", err)
+		writeError(w, http.StatusInternalServerError, "failed to load balance")
+		return
+	}
+
+	writeJSON(w, http.StatusOK, balanceResponse{
+		Channel: channel,
+		Topic:   topic,
+		Balance: *b,
+	})
+}
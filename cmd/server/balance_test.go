@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
+)
+
+func TestBalanceHandler(t *testing.T) {
+	found := fakeUserLookup(&User{ID: "3", Login: "bob", DisplayName: "Bob"})
+	lookup := func(ctx context.Context, names []string) ([]*User, error) {
+		if slices.Contains(names, "flaky") {
+			return nil, &twclient.APIError{StatusCode: http.StatusServiceUnavailable}
+		}
+		return found(ctx, names)
+	}
+	ledger := &fakeLedger{
+		users: map[string]*Balance{
+			"1": {Total: 7, Positive: 9, Negative: -2},
+			"3": {Total: 5, Positive: 7, Negative: -2},
+		},
+		topics: map[string]*Balance{"pizza": {Total: -1, Positive: 1, Negative: -2}},
+	}
+
+	for _, tc := range []struct {
+		path     string
+		err      error
+		status   int
+		expected string
+	}{
+		{"/balance/1", nil, http.StatusOK, `7`},
+		{"/balance/1/user/Bob", nil, http.StatusOK, `{"channel":"1","user":{"id":"3","login":"bob","display_name":"Bob"},"total":5,"positive":7,"negative":-2}`},
+		{"/balance/1/user/nobody", nil, http.StatusNotFound, `{"error":"user not found","code":404}`},
+		{"/balance/1/user/flaky", nil, http.StatusBadGateway, `{"error":"failed to look up user","code":502}`},
+		{"/balance/1/topic/Pizza", nil, http.StatusOK, `{"channel":"1","topic":"pizza","total":-1,"positive":1,"negative":-2}`},
+		{"/balance/1", errors.New("clickhouse is down"), http.StatusInternalServerError, `{"error":"failed to load balance","code":500}`},
+		{"/balance/1/topic/pizza", errors.New("clickhouse is down"), http.StatusInternalServerError, `{"error":"failed to load balance","code":500}`},
+	} {
+		ledger.err = tc.err
+		balances := &BalanceHandler{Store: ledger, Users: NewUserCache(10, lookup, lookup)}
+		mux := http.NewServeMux()
+		mux.HandleFunc("GET /balance/{id}", balances.Streamer)
+		mux.HandleFunc("GET /balance/{channel}/user/{login}", balances.User)
+		mux.HandleFunc("GET /balance/{channel}/topic/{topic}", balances.Topic)
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", tc.path, nil))
+		if w.Code != tc.status {
+			t.Errorf("%s: expected status %d got %d", tc.path, tc.status, w.Code)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != tc.expected {
+			t.Errorf("%s: expected body %s got %s", tc.path, tc.expected, got)
+		}
+	}
+}
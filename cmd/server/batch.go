@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var errSinkClosed = errors.New("sink closed")
+
+// BatchingClickhouseSink queues transactions and writes them to clickhouse in
+// batches, flushing whenever MaxBatchSize is reached or FlushInterval elapses.
+type BatchingClickhouseSink struct {
+	Downstream    BatchSink
+	MaxBatchSize  int
+	FlushInterval time.Duration
+
+	queue chan Transaction
+	done  chan struct{}
+
+	closeMutex sync.RWMutex
+	closed     bool
+}
+
+func NewBatchingClickhouseSink(downstream BatchSink, maxBatchSize int, flushInterval time.Duration, queueSize int) *BatchingClickhouseSink {
+	b := &BatchingClickhouseSink{
+		Downstream:    downstream,
+		MaxBatchSize:  maxBatchSize,
+		FlushInterval: flushInterval,
+		queue:         make(chan Transaction, queueSize),
+		done:          make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// Insert enqueues the transaction. It only blocks if the queue is full.
+func (b *BatchingClickhouseSink) Insert(ctx context.Context, t Transaction) error {
+	b.closeMutex.RLock()
+	defer b.closeMutex.RUnlock()
+	if b.closed {
+		return errSinkClosed
+	}
+
+	select {
+	case b.queue <- t:
+		batchQueueDepth.Set(float64(len(b.queue)))
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Len is the number of transactions waiting to be flushed.
+func (b *BatchingClickhouseSink) Len() int {
+	return len(b.queue)
+}
+
+// Close stops accepting transactions and waits for the queue to drain or ctx
+// to expire.
+func (b *BatchingClickhouseSink) Close(ctx context.Context) error {
+	b.closeMutex.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.queue)
+	}
+	b.closeMutex.Unlock()
+
+	select {
+	case <-b.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (b *BatchingClickhouseSink) run() {
+	defer close(b.done)
+
+	ticker := time.NewTicker(b.FlushInterval)
+	defer ticker.Stop()
+
+	pending := make([]Transaction, 0, b.MaxBatchSize)
+	for {
+		select {
+		case t, ok := <-b.queue:
+			if !ok {
+				b.flush(pending)
+				return
+			}
+			pending = append(pending, t)
+			if len(pending) >= b.MaxBatchSize {
+				b.flush(pending)
+				pending = pending[:0]
+			}
+		case <-ticker.C:
+			b.flush(pending)
+			pending = pending[:0]
+		}
+		batchQueueDepth.Set(float64(len(b.queue)))
+	}
+}
+
+func (b *BatchingClickhouseSink) flush(pending []Transaction) {
+	if len(pending) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	err := b.Downstream.InsertBatch(ctx, pending)
+	batchFlushLatency.Observe(time.Since(start).Seconds())
+	batchSize.Observe(float64(len(pending)))
+	if err != nil {
+		batchFlushErrors.Inc()
+		slog.Error("flushing batch", "size", len(pending), "err", err)
+		return
+	}
+	slog.Debug("flushed batch", "size", len(pending))
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBatchingSinkFlushesFullBatches(t *testing.T) {
+	ctx := context.Background()
+	down := &fakeBatchSink{}
+	b := NewBatchingClickhouseSink(down, 3, time.Hour, 10)
+
+	for i := 0; i < 7; i++ {
+		if err := b.Insert(ctx, testTransaction(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return down.received() >= 6 })
+
+	// The leftover is only written once the sink is closed
+	if err := b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	down.mu.Lock()
+	defer down.mu.Unlock()
+	if !cmp.Equal(down.batches, []int{3, 3, 1}) {
+		t.Errorf("expected batches of 3, 3 and 1, got %v", down.batches)
+	}
+}
+
+func TestBatchingSinkFlushesOnInterval(t *testing.T) {
+	ctx := context.Background()
+	down := &fakeBatchSink{}
+	b := NewBatchingClickhouseSink(down, 100, 10*time.Millisecond, 10)
+	defer b.Close(ctx)
+
+	for i := 0; i < 2; i++ {
+		if err := b.Insert(ctx, testTransaction(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	waitFor(t, func() bool { return down.received() == 2 })
+}
+
+func TestBatchingSinkClose(t *testing.T) {
+	ctx := context.Background()
+	down := &fakeBatchSink{}
+	b := NewBatchingClickhouseSink(down, 100, time.Hour, 10)
+
+	if err := b.Insert(ctx, testTransaction(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if down.received() != 1 {
+		t.Errorf("expected close to flush the queue, got %d transactions", down.received())
+	}
+	if err := b.Insert(ctx, testTransaction(1)); !errors.Is(err, errSinkClosed) {
+		t.Errorf("expected inserts after close to fail, got %v", err)
+	}
+	// Closing twice is harmless
+	if err := b.Close(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after a few seconds.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for condition")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
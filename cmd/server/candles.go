@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
+)
+
+var candleIntervals = map[string]time.Duration{
+	"1m": time.Minute,
+	"5m": 5 * time.Minute,
+	"1h": time.Hour,
+	"1d": 24 * time.Hour,
+}
+
+const maxCandles = 1000
+
+// CandleStore is the query the candle endpoint needs.
+type CandleStore interface {
+	Candles(ctx context.Context, channel string, targetUser string, targetTopic string, interval time.Duration, from time.Time, to time.Time) ([]Candle, error)
+}
+
+// CandleHandler serves GET /candles/{channel}.
+//
+//	target    #topic, @login or a user id. Defaults to the channel owner.
+//	interval  one of 1m, 5m, 1h, 1d. Defaults to 5m.
+//	from, to  RFC3339 or unix seconds. Defaults to the last 100 intervals.
+type CandleHandler struct {
+	Store CandleStore
+	Users *UserCache
+}
+
+func (h *CandleHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	channel := r.PathValue("channel")
+	q := r.URL.Query()
+
+	intervalParam := q.Get("interval")
+	if intervalParam == "" {
+		intervalParam = "5m"
+	}
+	interval, ok := candleIntervals[intervalParam]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "interval must be one of 1m, 5m, 1h, 1d")
+		return
+	}
+
+	to := time.Now()
+	if v := q.Get("to"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid to: "+err.Error())
+			return
+		}
+		to = t
+	}
+	from := to.Add(-100 * interval)
+	if v := q.Get("from"); v != "" {
+		t, err := parseTimeParam(v)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, "invalid from: "+err.Error())
+			return
+		}
+		from = t
+	}
+	if !from.Before(to) {
+		writeError(w, http.StatusBadRequest, "from must be before to")
+		return
+	}
+	if to.Sub(from)/interval > maxCandles {
+		writeError(w, http.StatusBadRequest, "range is too large for interval")
+		return
+	}
+
+	targetUser, targetTopic := channel, ""
+	switch target := q.Get("target"); {
+	case target == "":
+	case strings.HasPrefix(target, "#"):
+		targetUser, targetTopic = "", target[1:]
+	case strings.HasPrefix(target, "@"):
+		u, err := h.Users.GetByDisplayName(r.Context(), target[1:])
+		if errors.Is(err, twclient.ErrNotFound) {
+			writeError(w, http.StatusNotFound, "user not found")
+			return
+		}
+		if err != nil {
+			slog.Error("resolving user for candles", "target", target, "err", err)
+			writeError(w, http.StatusBadGateway, "failed to look up user")
+			return
+		}
+		targetUser = u.ID
+	default:
+		targetUser = target
+	}
+
+	candles, err := h.Store.Candles(r.Context(), channel, targetUser, targetTopic, interval, from, to)
+	if err != nil {
+		slog.Error("querying candles", "channel", channel, "err", err)
+		writeError(w, http.StatusInternalServerError, "failed to load candles")
+		return
+	}
+	if candles == nil {
+		candles = []Candle{}
+	}
+
+	writeJSON(w, http.StatusOK, candles)
+}
+
+func parseTimeParam(v string) (time.Time, error) {
+	if secs, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return time.Unix(secs, 0), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
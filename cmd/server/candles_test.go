@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestBucketCandles(t *testing.T) {
+	at := func(minute int) time.Time {
+		return time.Date(2024, 4, 1, 12, minute, 0, 0, time.UTC)
+	}
+
+	minutes := []minuteBalance{
+		{at(0), 2, 12},
+		{at(2), -5, 7},
+		{at(4), 1, 8},
+		{at(5), 4, 12},
+		{at(14), -1, 11},
+	}
+
+	for _, tc := range []struct {
+		interval time.Duration
+		expected []Candle
+	}{
+		{5 * time.Minute, []Candle{
+			{Time: at(0), Open: 10, High: 12, Low: 7, Close: 8},
+			{Time: at(5), Open: 8, High: 12, Low: 8, Close: 12},
+			{Time: at(10), Open: 12, High: 12, Low: 11, Close: 11},
+		}},
+		{time.Hour, []Candle{
+			{Time: at(0), Open: 10, High: 12, Low: 7, Close: 11},
+		}},
+	} {
+		got := bucketCandles(minutes, tc.interval)
+		if !cmp.Equal(got, tc.expected) {
+			t.Errorf("%s: did not match expected candles\n%s", tc.interval, cmp.Diff(got, tc.expected))
+		}
+	}
+
+	if got := bucketCandles(nil, time.Minute); got != nil {
+		t.Errorf("expected no candles without votes, got %v", got)
+	}
+}
+
+type candleQuery struct {
+	Channel, TargetUser, TargetTopic string
+	Interval                         time.Duration
+}
+
+type fakeCandleStore struct {
+	queries []candleQuery
+}
+
+func (f *fakeCandleStore) Candles(ctx context.Context, channel string, targetUser string, targetTopic string, interval time.Duration, from time.Time, to time.Time) ([]Candle, error) {
+	f.queries = append(f.queries, candleQuery{channel, targetUser, targetTopic, interval})
+	return nil, nil
+}
+
+func TestCandleHandler(t *testing.T) {
+	lookup := fakeUserLookup(&User{ID: "3", Login: "bob", DisplayName: "Bob"})
+
+	for _, tc := range []struct {
+		query    string
+		status   int
+		expected *candleQuery
+	}{
+		{"", http.StatusOK, &candleQuery{"1", "1", "", 5 * time.Minute}},
+		{"?interval=1h&target=%23pizza", http.StatusOK, &candleQuery{"1", "", "pizza", time.Hour}},
+		{"?target=@bob", http.StatusOK, &candleQuery{"1", "3", "", 5 * time.Minute}},
+		{"?target=42", http.StatusOK, &candleQuery{"1", "42", "", 5 * time.Minute}},
+		{"?target=@nobody", http.StatusNotFound, nil},
+		{"?interval=2m", http.StatusBadRequest, nil},
+		{"?from=2024-04-01T12:00:00Z&to=2024-04-01T11:00:00Z", http.StatusBadRequest, nil},
+		{"?interval=1m&from=0", http.StatusBadRequest, nil},
+		{"?to=yesterday", http.StatusBadRequest, nil},
+	} {
+		store := &fakeCandleStore{}
+		mux := http.NewServeMux()
+		mux.Handle("GET /candles/{channel}", &CandleHandler{Store: store, Users: NewUserCache(10, lookup, lookup)})
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/candles/1"+tc.query, nil))
+		if w.Code != tc.status {
+			t.Errorf("%q: expected status %d got %d: %s", tc.query, tc.status, w.Code, w.Body)
+			continue
+		}
+		if tc.expected == nil {
+			if len(store.queries) != 0 {
+				t.Errorf("%q: expected no query, got %v", tc.query, store.queries)
+			}
+			continue
+		}
+		if !cmp.Equal(store.queries, []candleQuery{*tc.expected}) {
+			t.Errorf("%q: did not match expected query\n%s", tc.query, cmp.Diff(store.queries, []candleQuery{*tc.expected}))
+		}
+		var candles []Candle
+		if err := json.Unmarshal(w.Body.Bytes(), &candles); err != nil || candles == nil {
+			t.Errorf("%q: expected an empty list, got %s", tc.query, w.Body)
+		}
+	}
+}
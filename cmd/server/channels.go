@@ -0,0 +1,300 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
+)
+
+var errUnknownChannel = errors.New("channel not joined")
+
+// Channel is a twitch channel the bot watches.
+type Channel struct {
+	Login       string `json:"login"`
+	RoomID      string `json:"room_id"`
+	DisplayName string `json:"display_name"`
+}
+
+// IRCJoiner is the subset of the irc client used to manage channels.
+type IRCJoiner interface {
+	Join(channels ...string)
+	Depart(channel string)
+}
+
+// ChannelStore persists the set of joined channels.
+type ChannelStore interface {
+	ListChannels(ctx context.Context) ([]Channel, error)
+	SaveChannel(ctx context.Context, ch Channel, active bool) error
+	// HasChannels reports whether any channel has ever been stored, including
+	// ones that were since parted.
+	HasChannels(ctx context.Context) (bool, error)
+}
+
+// ChannelManager tracks which channels the bot is in and keeps the irc client
+// and the store in agreement.
+type ChannelManager struct {
+	IRC     IRCJoiner
+	Store   ChannelStore
+	Resolve UserLoadingFunction
+
+	mu       sync.Mutex
+	channels map[string]Channel
+}
+
+func NewChannelManager(irc IRCJoiner, store ChannelStore, resolve UserLoadingFunction) *ChannelManager {
+	return &ChannelManager{
+		IRC:      irc,
+		Store:    store,
+		Resolve:  resolve,
+		channels: make(map[string]Channel),
+	}
+}
+
+// Load joins every stored channel. If nothing has ever been stored the seed
+// channels are onboarded instead, a store where every channel was parted
+// stays empty. Seeds that can't be resolved yet are stored
+// without a room id, and joined by login until ResolvePending manages it.
+func (m *ChannelManager) Load(ctx context.Context, seed []string) error {
+	seeded, err := m.Store.HasChannels(ctx)
+	if err != nil {
+		return fmt.Errorf("checking for channels: %w", err)
+	}
+
+	if !seeded {
+		slog.Info("no stored channels, seeding", "channels", seed)
+		for _, login := range seed {
+			if _, err := m.Join(ctx, login); err != nil {
+				slog.Error("onboarding seed channel, will retry", "channel", login, "err", err)
+				ch := Channel{Login: strings.ToLower(login)}
+				if err := m.Store.SaveChannel(ctx, ch, true); err != nil {
+					return fmt.Errorf("saving seed channel %s: %w", login, err)
+				}
+				m.join(ch)
+			}
+		}
+		return nil
+	}
+
+	stored, err := m.Store.ListChannels(ctx)
+	if err != nil {
+		return fmt.Errorf("listing channels: %w", err)
+	}
+	for _, ch := range stored {
+		m.join(ch)
+	}
+	return nil
+}
+
+// ResolvePending retries resolving channels that were stored without a room
+// id, returning how many are still unresolved.
+func (m *ChannelManager) ResolvePending(ctx context.Context) int {
+	var unresolved int
+	for _, ch := range m.List() {
+		if ch.RoomID != "" {
+			continue
+		}
+		if _, err := m.Join(ctx, ch.Login); err != nil {
+			slog.Warn("resolving channel", "channel", ch.Login, "err", err)
+			unresolved++
+		}
+	}
+	return unresolved
+}
+
+// RetryPending calls ResolvePending every interval until nothing is left
+// unresolved or ctx ends.
+func (m *ChannelManager) RetryPending(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if m.ResolvePending(ctx) == 0 {
+			return
+		}
+	}
+}
+
+// Join resolves the broadcaster, persists the channel and joins it in irc.
+func (m *ChannelManager) Join(ctx context.Context, login string) (Channel, error) {
+	u, err := m.Resolve(ctx, strings.ToLower(login))
+	if err != nil {
+		return Channel{}, fmt.Errorf("resolving broadcaster: %w", err)
+	}
+
+	ch := Channel{
+		Login:       strings.ToLower(u.Login),
+		RoomID:      u.ID,
+		DisplayName: u.DisplayName,
+	}
+	if err := m.Store.SaveChannel(ctx, ch, true); err != nil {
+		return Channel{}, fmt.Errorf("saving channel: %w", err)
+	}
+
+	m.join(ch)
+	return ch, nil
+}
+
+func (m *ChannelManager) join(ch Channel) {
+	m.mu.Lock()
+	m.channels[ch.Login] = ch
+	m.mu.Unlock()
+
+	m.IRC.Join(ch.Login)
+	joinedChannels.Set(float64(len(m.List())))
+}
+
+// Part leaves the channel and removes it from the store.
+func (m *ChannelManager) Part(ctx context.Context, login string) error {
+	login = strings.ToLower(login)
+
+	m.mu.Lock()
+	ch, ok := m.channels[login]
+	m.mu.Unlock()
+	if !ok {
+		return errUnknownChannel
+	}
+
+	if err := m.Store.SaveChannel(ctx, ch, false); err != nil {
+		return fmt.Errorf("saving channel: %w", err)
+	}
+
+	m.mu.Lock()
+	delete(m.channels, login)
+	m.mu.Unlock()
+
+	m.IRC.Depart(login)
+	joinedChannels.Set(float64(len(m.List())))
+	return nil
+}
+
+// List returns the joined channels sorted by login.
+func (m *ChannelManager) List() []Channel {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	channels := make([]Channel, 0, len(m.channels))
+	for _, ch := range m.channels {
+		channels = append(channels, ch)
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Login < channels[j].Login
+	})
+	return channels
+}
+
+// ChannelAdminHandler exposes the ChannelManager over http, authenticated
+// with a static bearer token.
+//
+//	GET    /admin/channels
+//	PUT    /admin/channels/{login}
+//	DELETE /admin/channels/{login}
+type ChannelAdminHandler struct {
+	Channels *ChannelManager
+	Token    string
+}
+
+func (h *ChannelAdminHandler) Register(mux *http.ServeMux) {
+	mux.HandleFunc("GET /admin/channels", h.authenticated(h.list))
+	mux.HandleFunc("PUT /admin/channels/{login}", h.authenticated(h.join))
+	mux.HandleFunc("DELETE /admin/channels/{login}", h.authenticated(h.part))
+}
+
+func (h *ChannelAdminHandler) authenticated(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(h.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next(w, r)
+	}
+}
+
+func (h *ChannelAdminHandler) list(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.Channels.List())
+}
+
+func (h *ChannelAdminHandler) join(w http.ResponseWriter, r *http.Request) {
+	login := r.PathValue("login")
+
+	ch, err := h.Channels.Join(r.Context(), login)
+	if errors.Is(err, twclient.ErrNotFound) {
+		writeError(w, http.StatusNotFound, "no such twitch user")
+		return
+	}
+	if err != nil {
+		slog.Error("joining channel", "channel", login, "err", err)
+		writeError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	slog.Info("joined channel", "channel", ch.Login, "roomID", ch.RoomID)
+
+	writeJSON(w, http.StatusOK, ch)
+}
+
+func (h *ChannelAdminHandler) part(w http.ResponseWriter, r *http.Request) {
+	login := r.PathValue("login")
+
+	err := h.Channels.Part(r.Context(), login)
+	if errors.Is(err, errUnknownChannel) {
+		writeError(w, http.StatusNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		slog.Error("parting channel", "channel", login, "err", err)
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	slog.Info("parted channel", "channel", login)
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *ClickhouseStore) ListChannels(ctx context.Context) ([]Channel, error) {
+	rows, err := s.CHConn.Query(ctx, `
+    SELECT login, room_id, display_name
+    FROM pulse.channels FINAL
+    WHERE active
+    ORDER BY login
+  `)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var channels []Channel
+	for rows.Next() {
+		var ch Channel
+		if err := rows.Scan(&ch.Login, &ch.RoomID, &ch.DisplayName); err != nil {
+			return nil, err
+		}
+		channels = append(channels, ch)
+	}
+	return channels, rows.Err()
+}
+
+func (s *ClickhouseStore) HasChannels(ctx context.Context) (bool, error) {
+	var n uint64
+	err := s.CHConn.QueryRow(ctx, `SELECT count() FROM pulse.channels`).Scan(&n)
+	return n > 0, err
+}
+
+func (s *ClickhouseStore) SaveChannel(ctx context.Context, ch Channel, active bool) error {
+	return s.CHConn.Exec(ctx, `
+    INSERT INTO pulse.channels (login, room_id, display_name, active, updated_at)
+    VALUES (?, ?, ?, ?, ?)
+  `, ch.Login, ch.RoomID, ch.DisplayName, active, time.Now())
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeIRC struct {
+	mu     sync.Mutex
+	joined map[string]bool
+}
+
+func (f *fakeIRC) Join(channels ...string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ch := range channels {
+		f.joined[ch] = true
+	}
+}
+
+func (f *fakeIRC) Depart(channel string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.joined, channel)
+}
+
+type fakeChannelStore struct {
+	mu       sync.Mutex
+	channels map[string]Channel
+	saved    bool
+}
+
+func (f *fakeChannelStore) ListChannels(ctx context.Context) ([]Channel, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var channels []Channel
+	for _, ch := range f.channels {
+		channels = append(channels, ch)
+	}
+	return channels, nil
+}
+
+func (f *fakeChannelStore) SaveChannel(ctx context.Context, ch Channel, active bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.saved = true
+	if active {
+		f.channels[ch.Login] = ch
+	} else {
+		delete(f.channels, ch.Login)
+	}
+	return nil
+}
+
+func (f *fakeChannelStore) HasChannels(ctx context.Context) (bool, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.saved, nil
+}
+
+// fakeTwitch resolves the users it knows, and fails for the rest while down.
+type fakeTwitch struct {
+	mu    sync.Mutex
+	users map[string]*User
+	down  bool
+}
+
+func (f *fakeTwitch) resolve(ctx context.Context, login string) (*User, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.down {
+		return nil, &twclient.APIError{StatusCode: http.StatusServiceUnavailable}
+	}
+	if u, ok := f.users[login]; ok {
+		return u, nil
+	}
+	return nil, errUserNotFound
+}
+
+func newTestChannelManager() (*ChannelManager, *fakeIRC, *fakeChannelStore, *fakeTwitch) {
+	irc := &fakeIRC{joined: make(map[string]bool)}
+	store := &fakeChannelStore{channels: make(map[string]Channel)}
+	tw := &fakeTwitch{users: map[string]*User{
+		"alice": {ID: "1", Login: "alice", DisplayName: "Alice"},
+		"bob":   {ID: "2", Login: "bob", DisplayName: "Bob"},
+	}}
+	return NewChannelManager(irc, store, tw.resolve), irc, store, tw
+}
+
+func TestChannelManagerSeeds(t *testing.T) {
+	ctx := context.Background()
+	m, irc, store, tw := newTestChannelManager()
+
+	// bob can't be resolved while twitch is down, but is still joined
+	tw.down = true
+	if err := m.Load(ctx, []string{"Alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if !irc.joined["alice"] || !irc.joined["bob"] {
+		t.Errorf("expected every seed to be joined, got %v", irc.joined)
+	}
+	if ch := store.channels["bob"]; ch.Login != "bob" || ch.RoomID != "" {
+		t.Errorf("expected bob to be stored unresolved, got %+v", ch)
+	}
+	if n := m.ResolvePending(ctx); n != 2 {
+		t.Errorf("expected 2 unresolved channels, got %d", n)
+	}
+
+	// A restart finds the unresolved seeds in the store
+	irc = &fakeIRC{joined: make(map[string]bool)}
+	m = NewChannelManager(irc, store, tw.resolve)
+	if err := m.Load(ctx, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !irc.joined["bob"] {
+		t.Errorf("expected stored channels to be joined, got %v", irc.joined)
+	}
+
+	tw.down = false
+	if n := m.ResolvePending(ctx); n != 0 {
+		t.Errorf("expected every channel to resolve, %d left", n)
+	}
+	expected := []Channel{
+		{Login: "alice", RoomID: "1", DisplayName: "Alice"},
+		{Login: "bob", RoomID: "2", DisplayName: "Bob"},
+	}
+	if !cmp.Equal(m.List(), expected) {
+		t.Errorf("did not match expected channels\n%s", cmp.Diff(m.List(), expected))
+	}
+	if !cmp.Equal(store.channels["bob"], expected[1]) {
+		t.Errorf("expected the resolved channel to be stored, got %+v", store.channels["bob"])
+	}
+}
+
+func TestChannelAdminHandler(t *testing.T) {
+	m, irc, store, _ := newTestChannelManager()
+	mux := http.NewServeMux()
+	(&ChannelAdminHandler{Channels: m, Token: "secret"}).Register(mux)
+
+	do := func(method, path, token string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, tc := range []struct {
+		method, path, token string
+		status              int
+	}{
+		{"GET", "/admin/channels", "", http.StatusUnauthorized},
+		{"GET", "/admin/channels", "wrong", http.StatusUnauthorized},
+		{"PUT", "/admin/channels/Alice", "secret", http.StatusOK},
+		{"PUT", "/admin/channels/nobody", "secret", http.StatusNotFound},
+		{"DELETE", "/admin/channels/bob", "secret", http.StatusNotFound},
+		{"PUT", "/admin/channels/bob", "secret", http.StatusOK},
+		{"DELETE", "/admin/channels/bob", "secret", http.StatusNoContent},
+	} {
+		if w := do(tc.method, tc.path, tc.token); w.Code != tc.status {
+			t.Errorf("%s %s: expected status %d got %d: %s", tc.method, tc.path, tc.status, w.Code, w.Body)
+		}
+	}
+
+	w := do("GET", "/admin/channels", "secret")
+	var got []Channel
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	expected := []Channel{{Login: "alice", RoomID: "1", DisplayName: "Alice"}}
+	if !cmp.Equal(got, expected) {
+		t.Errorf("did not match expected channels\n%s", cmp.Diff(got, expected))
+	}
+	if !irc.joined["alice"] || irc.joined["bob"] {
+		t.Errorf("expected only alice to be joined, got %v", irc.joined)
+	}
+	if _, ok := store.channels["bob"]; ok {
+		t.Error("expected bob to be removed from the store")
+	}
+
+	// Parting every channel isn't undone by the seeds on restart
+	if w := do("DELETE", "/admin/channels/alice", "secret"); w.Code != http.StatusNoContent {
+		t.Fatalf("expected status %d got %d: %s", http.StatusNoContent, w.Code, w.Body)
+	}
+	irc = &fakeIRC{joined: make(map[string]bool)}
+	m = NewChannelManager(irc, store, m.Resolve)
+	if err := m.Load(context.Background(), []string{"alice", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+	if len(irc.joined) != 0 || len(m.List()) != 0 {
+		t.Errorf("expected no channels after a restart, joined %v", irc.joined)
+	}
+}
@@ -3,19 +3,24 @@ package main
 import (
 	"container/list"
 	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"regexp"
-	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
 
 	twitchirc "github.com/gempir/go-twitch-irc/v4"
 )
 
 type User struct {
-	ID          string
-	Login       string
-	DisplayName string
+	ID          string `json:"id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
 }
 
 // ChatHandler is a Transaction source, that
@@ -23,11 +28,41 @@ type ChatHandler struct {
 	RootContext context.Context
 	UserCache   *UserCache
 	TSink       TransactionSink
+	RateLimiter *RateLimiter
+	Policy      *VotePolicy
+	Commands    *CommandRouter
+
+	// Parsers holds per channel vote grammars, keyed by channel name.
+	Parsers       map[string]VoteParser
+	DefaultParser VoteParser
+
+	// RetryDelay is how long a vote waits before its target lookup is retried,
+	// doubling each attempt. Defaults to voteRetryDelay.
+	RetryDelay time.Duration
+
+	pending   sync.WaitGroup
+	lookups   atomic.Int32
+	retrying  atomic.Int32
+	stopOnce  sync.Once
+	closeOnce sync.Once
+	stopped   chan struct{}
 }
 
-var (
-	numberMatcher = regexp.MustCompile(`[+-][12]`)
-	topicMatcher  = regexp.MustCompile(`[@#][a-zA-Z]+`)
+// validLogin matches what twitch allows in a login. Helix fails the whole
+// request if any login in it is malformed.
+var validLogin = regexp.MustCompile(`^[a-z0-9_]{1,25}$`)
+
+const (
+	// maxPendingLookups bounds how many votes wait on a user lookup at once.
+	maxPendingLookups = 1000
+
+	// The twitch client rides out blips within a lookup, these carry a vote
+	// through an outage longer than that, about a minute in all.
+	voteRetryDelay    = 2 * time.Second
+	voteRetryAttempts = 6
+	// maxRetryingVotes bounds how many votes wait on a retry at once, so a
+	// helix outage can't pile up goroutines.
+	maxRetryingVotes = 1000
 )
 
 type match struct {
@@ -36,30 +71,15 @@ type match struct {
 	Topic string
 }
 
-func matchMessage(m string) *match {
-	v := numberMatcher.FindString(m)
-	if v == "" {
-		return nil
-	}
-
-	val, err := strconv.Atoi(v)
-	if err != nil {
-		return nil
-	}
-
-	ma := &match{
-		Value: val,
-	}
-
-	tmatch := topicMatcher.FindString(m)
-	if strings.HasPrefix(tmatch, "@") {
-		ma.User = tmatch[1:]
+// parserFor picks the vote grammar configured for a channel.
+func (c *ChatHandler) parserFor(channel string) VoteParser {
+	if p, ok := c.Parsers[channel]; ok {
+		return p
 	}
-	if strings.HasPrefix(tmatch, "#") {
-		ma.Topic = tmatch[1:]
+	if c.DefaultParser != nil {
+		return c.DefaultParser
 	}
-
-	return ma
+	return defaultParser
 }
 
 func (c *ChatHandler) HandleMessage(m twitchirc.PrivateMessage) {
@@ -72,13 +92,78 @@ func (c *ChatHandler) HandleMessage(m twitchirc.PrivateMessage) {
 		Login:       m.User.Name,
 	})
 
+	if c.Commands != nil && c.Commands.IsCommand(m.Channel, m.Message) {
+		c.Commands.Handle(ctx, m)
+		return
+	}
+
+	message := m.Message
+	if m.Reply != nil {
+		// The parent author is a known user too
+		c.UserCache.Insert(&User{
+			ID:          m.Reply.ParentUserID,
+			DisplayName: m.Reply.ParentDisplayName,
+			Login:       m.Reply.ParentUserLogin,
+		})
+		message = stripReplyMention(message, m.Reply.ParentUserLogin)
+	}
+
 	// Parse message
-	match := matchMessage(m.Message)
-	if match == nil {
+	matches := c.parserFor(m.Channel).Parse(message)
+	if len(matches) == 0 {
 		slog.Debug("Dropping message", "message", m.Message)
 		return
 	}
 
+	for _, match := range matches {
+		if match.User != "" && !c.UserCache.Cached(match.User) {
+			if !validLogin.MatchString(strings.ToLower(match.User)) {
+				// Helix can only find it by login, display names like this
+				// are only known once their owner has chatted
+				votesRejected.WithLabelValues(m.Channel, "unknown_user").Inc()
+				continue
+			}
+			if c.lookups.Add(1) > maxPendingLookups {
+				c.lookups.Add(-1)
+				votesRejected.WithLabelValues(m.Channel, "lookup_backlog").Inc()
+				continue
+			}
+			// Backfills are batched across messages, so don't hold up chat
+			// waiting for one
+			c.pending.Add(1)
+			go func() {
+				defer c.pending.Done()
+				defer c.lookups.Add(-1)
+				c.handleVote(ctx, m, match)
+			}()
+			continue
+		}
+		c.handleVote(ctx, m, match)
+	}
+}
+
+// Wait blocks until votes waiting on a user lookup have been handled.
+func (c *ChatHandler) Wait() {
+	c.pending.Wait()
+}
+
+// Stop gives up on votes waiting on a user lookup or its retry, so Wait
+// doesn't sit out their backoff. It's safe to call more than once.
+func (c *ChatHandler) Stop() {
+	stopped := c.stopChan()
+	c.closeOnce.Do(func() {
+		close(stopped)
+	})
+}
+
+func (c *ChatHandler) stopChan() chan struct{} {
+	c.stopOnce.Do(func() {
+		c.stopped = make(chan struct{})
+	})
+	return c.stopped
+}
+
+func (c *ChatHandler) handleVote(ctx context.Context, m twitchirc.PrivateMessage, match match) {
 	if match.Value == 0 {
 		slog.Warn("parsed a vote but value was 0", "message", m.Message)
 		return
@@ -86,23 +171,38 @@ func (c *ChatHandler) HandleMessage(m twitchirc.PrivateMessage) {
 
 	tt := "anon"
 	targetUserID := ""
+	targetLogin := ""
+	fromReply := false
 	targetTopic := match.Topic
 	if match.Topic != "" {
 		tt = "topic"
 	} else {
 		targetUserID = m.RoomID
-		if match.User != "" {
-			u, err := c.UserCache.GetByDisplayName(ctx, match.User)
+		targetLogin = m.Channel
+		switch {
+		case match.User != "":
+			u, err := c.lookupTarget(ctx, m.Channel, match.User)
 			if err != nil {
+				if errors.Is(err, twclient.ErrNotFound) {
+					votesRejected.WithLabelValues(m.Channel, "unknown_user").Inc()
+					slog.Debug("dropping vote for unknown user", "DisplayName", match.User)
+					return
+				}
+				votesRejected.WithLabelValues(m.Channel, "lookup_failed").Inc()
 				slog.Error("loading user", "DisplayName", match.User, "err", err)
 				return
 			}
 			targetUserID = u.ID
+			targetLogin = u.Login
+		case m.Reply != nil:
+			// A bare vote in a reply is aimed at whoever they replied to
+			tt = "reply"
+			targetUserID = m.Reply.ParentUserID
+			targetLogin = m.Reply.ParentUserLogin
+			fromReply = true
 		}
 	}
 
-	votesProcessed.WithLabelValues(m.Channel, tt).Inc()
-
 	t := Transaction{
 		Channel:     m.RoomID,
 		Source:      m.User.ID,
@@ -110,8 +210,25 @@ func (c *ChatHandler) HandleMessage(m twitchirc.PrivateMessage) {
 		TargetTopic: targetTopic,
 		Value:       match.Value,
 		Timestamp:   m.Time,
+		FromReply:   fromReply,
+	}
+
+	if c.Policy != nil {
+		if reason := c.Policy.Check(m, t, targetLogin); reason != "" {
+			votesRejected.WithLabelValues(m.Channel, reason).Inc()
+			slog.Debug("vote rejected by policy", "reason", reason, "transaction", t)
+			return
+		}
 	}
 
+	if c.RateLimiter != nil && !c.RateLimiter.Allow(m.Channel, t) {
+		votesRateLimited.WithLabelValues(m.Channel, tt).Inc()
+		slog.Debug("rate limited vote", "transaction", t)
+		return
+	}
+
+	votesProcessed.WithLabelValues(m.Channel, tt).Inc()
+
 	err := c.TSink.Insert(ctx, t)
 	if err != nil {
 		slog.Error("inserting transaction", "err", err, "transaction", t)
@@ -119,43 +236,186 @@ func (c *ChatHandler) HandleMessage(m twitchirc.PrivateMessage) {
 	}
 }
 
+// lookupTarget resolves a vote's target, queueing it for retry with backoff
+// while helix is failing. Users that don't exist aren't retried.
+func (c *ChatHandler) lookupTarget(ctx context.Context, channel string, name string) (*User, error) {
+	if c.UserCache.Cached(name) {
+		return c.UserCache.GetByDisplayName(ctx, name)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.stopChan():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	u, err := c.UserCache.GetByDisplayName(ctx, name)
+	if err == nil || errors.Is(err, twclient.ErrNotFound) || ctx.Err() != nil {
+		return u, err
+	}
+
+	if c.retrying.Add(1) > maxRetryingVotes {
+		c.retrying.Add(-1)
+		return nil, fmt.Errorf("too many votes retrying: %w", err)
+	}
+	defer c.retrying.Add(-1)
+
+	delay := c.RetryDelay
+	if delay <= 0 {
+		delay = voteRetryDelay
+	}
+	for attempt := 1; attempt < voteRetryAttempts; attempt++ {
+		wait := delay
+		var apiErr *twclient.APIError
+		if errors.As(err, &apiErr) {
+			wait = max(wait, apiErr.RetryAfter)
+		}
+
+		votesRetried.WithLabelValues(channel).Inc()
+		t := time.NewTimer(wait)
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			t.Stop()
+			return nil, fmt.Errorf("stopped retrying: %w", err)
+		}
+
+		u, err = c.UserCache.GetByDisplayName(ctx, name)
+		if err == nil || errors.Is(err, twclient.ErrNotFound) || ctx.Err() != nil {
+			return u, err
+		}
+		delay *= 2
+	}
+	return nil, fmt.Errorf("giving up after %d attempts: %w", voteRetryAttempts, err)
+}
+
+// stripReplyMention removes the "@parent" twitch prepends to replies, so it
+// isn't mistaken for an explicit target.
+func stripReplyMention(message string, parentLogin string) string {
+	mention := "@" + parentLogin
+	first, rest, _ := strings.Cut(message, " ")
+	if strings.EqualFold(first, mention) {
+		return strings.TrimSpace(rest)
+	}
+	return message
+}
+
 type UserCache struct {
-	ByDisplayName map[string]*list.Element
-	Users         *list.List
-	Limit         int
-	BackfillFn    UserLoadingFunction
+	ByDisplayName  map[string]*list.Element
+	ByID           map[string]*list.Element
+	Users          *list.List
+	Limit          int
+	BackfillFn     UserBatchLoadingFunction
+	BackfillByIDFn UserBatchLoadingFunction
 
 	cacheLock sync.Mutex
+
+	// Misses are coalesced into batched backfills
+	byName *userBatcher
+	byID   *userBatcher
 }
 
-func NewUserCache(limit int, backfillFn UserLoadingFunction) *UserCache {
+func NewUserCache(limit int, backfillFn UserBatchLoadingFunction, backfillByIDFn UserBatchLoadingFunction) *UserCache {
 	// TODO: Instrument this so we can see how big the cache is
 	return &UserCache{
-		ByDisplayName: make(map[string]*list.Element),
-		Users:         list.New(),
-		Limit:         limit,
-		BackfillFn:    backfillFn,
+		ByDisplayName:  make(map[string]*list.Element),
+		ByID:           make(map[string]*list.Element),
+		Users:          list.New(),
+		Limit:          limit,
+		BackfillFn:     backfillFn,
+		BackfillByIDFn: backfillByIDFn,
+		byName:         newUserBatcher(backfillFn, normalizeName, (*User).names),
+		byID: newUserBatcher(backfillByIDFn, func(id string) string { return id }, func(u *User) []string {
+			return []string{u.ID}
+		}),
+	}
+}
+
+// names are the keys a user is cached under in ByDisplayName. Display names
+// usually only differ from the login by case, but localized ones don't.
+func (u *User) names() []string {
+	display, login := normalizeName(u.DisplayName), normalizeName(u.Login)
+	if login == "" || login == display {
+		return []string{display}
 	}
+	return []string{display, login}
 }
 
-type UserLoadingFunction func(ctx context.Context, username string) (*User, error)
+type UserLoadingFunction func(ctx context.Context, key string) (*User, error)
 
 func (c *UserCache) Insert(user *User) {
 	c.cacheLock.Lock()
 	defer c.cacheLock.Unlock()
+
+	// Replace any stale entry for this user, they may have changed their name
+	if el, ok := c.ByID[user.ID]; ok {
+		c.removeLocked(el)
+	}
+	for _, name := range user.names() {
+		if el, ok := c.ByDisplayName[name]; ok {
+			c.removeLocked(el)
+		}
+	}
+
 	if c.Users.Len() >= c.Limit {
-		last := c.Users.Back()
-		c.Users.Remove(last)
-		delete(c.ByDisplayName, last.Value.(*User).DisplayName)
+		c.removeLocked(c.Users.Back())
 	}
 
 	f := c.Users.PushFront(user)
-	c.ByDisplayName[user.DisplayName] = f
+	for _, name := range user.names() {
+		c.ByDisplayName[name] = f
+	}
+	c.ByID[user.ID] = f
 }
 
+func (c *UserCache) removeLocked(el *list.Element) {
+	user := c.Users.Remove(el).(*User)
+	for _, name := range user.names() {
+		if c.ByDisplayName[name] == el {
+			delete(c.ByDisplayName, name)
+		}
+	}
+	if c.ByID[user.ID] == el {
+		delete(c.ByID, user.ID)
+	}
+}
+
+// Cached reports whether GetByDisplayName can answer without a backfill.
+func (c *UserCache) Cached(name string) bool {
+	c.cacheLock.Lock()
+	defer c.cacheLock.Unlock()
+	_, ok := c.ByDisplayName[normalizeName(name)]
+	return ok
+}
+
+// GetByDisplayName finds a user by display name or login, ignoring case.
 func (c *UserCache) GetByDisplayName(ctx context.Context, id string) (*User, error) {
 	c.cacheLock.Lock()
-	if userEl, ok := c.ByDisplayName[id]; ok {
+	if userEl, ok := c.ByDisplayName[normalizeName(id)]; ok {
+		c.Users.MoveToFront(userEl)
+		user := userEl.Value.(*User)
+		c.cacheLock.Unlock()
+		return user, nil
+	}
+	c.cacheLock.Unlock()
+
+	// Backfill
+	user, err := c.byName.Get(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	c.Insert(user)
+
+	return user, nil
+}
+
+func (c *UserCache) GetByID(ctx context.Context, id string) (*User, error) {
+	c.cacheLock.Lock()
+	if userEl, ok := c.ByID[id]; ok {
 		c.Users.MoveToFront(userEl)
 		user := userEl.Value.(*User)
 		c.cacheLock.Unlock()
@@ -164,7 +424,7 @@ func (c *UserCache) GetByDisplayName(ctx context.Context, id string) (*User, err
 	c.cacheLock.Unlock()
 
 	// Backfill
-	user, err := c.BackfillFn(ctx, id)
+	user, err := c.byID.Get(ctx, id)
 	if err != nil {
 		return nil, err
 	}
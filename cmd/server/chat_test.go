@@ -1,58 +1,67 @@
 package main
 
 import (
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	twclient "github.com/cconger/pulse/pkg/twitch"
+	twitchirc "github.com/gempir/go-twitch-irc/v4"
 	"github.com/google/go-cmp/cmp"
 )
 
 func TestMatcher(t *testing.T) {
 	for _, tc := range []struct {
 		input    string
-		expected *match
+		expected []match
 	}{
 		{"foo", nil},
 		{
 			"@user -2",
-			&match{
+			[]match{{
 				Value: -2,
 				User:  "user",
-			},
+			}},
 		},
 		{
 			"@user +2",
-			&match{
+			[]match{{
 				Value: 2,
 				User:  "user",
-			},
+			}},
 		},
 		{
 			"@user +1",
-			&match{
+			[]match{{
 				Value: 1,
 				User:  "user",
-			},
+			}},
 		},
 		{
 			"@user -1",
-			&match{
+			[]match{{
 				Value: -1,
 				User:  "user",
-			},
+			}},
 		},
 		{
 			"-1 @user",
-			&match{
+			[]match{{
 				Value: -1,
 				User:  "user",
-			},
+			}},
 		},
 		{
 			"-1 #topic",
-			&match{
+			[]match{{
 				Value: -1,
 				Topic: "topic",
-			},
+			}},
 		},
 		{
 			"@user +3",
@@ -60,23 +69,81 @@ func TestMatcher(t *testing.T) {
 		},
 		{
 			"this messsage has a +2 in it",
-			&match{
+			[]match{{
 				Value: 2,
-			},
+			}},
 		},
 		{
 			"+2",
-			&match{
+			[]match{{
 				Value: 2,
-			},
+			}},
 		},
 		{
 			"+2 -2",
-			&match{
+			[]match{{
 				Value: 2,
-			},
+			}},
 		},
 		{"long message has doesn't have + two", nil},
+		{"score was 3+2-1", nil},
+		{"UTC+2", nil},
+		{"call +1 555 123 4567", nil},
+		{"https://example.com/#topic?a=+2", nil},
+		{"me@example.com +2", []match{{Value: 2}}},
+		{"(+2) @user!", []match{{Value: 2, User: "user"}}},
+		{"#pokémon +2", []match{{Value: 2, Topic: "pokémon"}}},
+		{"#poke\u0301mon +2", []match{{Value: 2, Topic: "pokémon"}}},
+		{"+2 #Game_2", []match{{Value: 2, Topic: "game_2"}}},
+		{"@user_123 +1", []match{{Value: 1, User: "user_123"}}},
+		{"+2 #原神", []match{{Value: 2, Topic: "原神"}}},
+		{
+			"+2 @alice -2 @bob",
+			[]match{
+				{Value: 2, User: "alice"},
+				{Value: -2, User: "bob"},
+			},
+		},
+		{
+			"@alice +2 @bob -1",
+			[]match{
+				{Value: 2, User: "alice"},
+				{Value: -1, User: "bob"},
+			},
+		},
+		{
+			"+2 #topic -1",
+			[]match{
+				{Value: 2, Topic: "topic"},
+				{Value: -1},
+			},
+		},
+		{
+			"+2 @alice +2 @alice",
+			[]match{
+				{Value: 2, User: "alice"},
+			},
+		},
+		{
+			"@alice +2 +2",
+			[]match{
+				{Value: 2, User: "alice"},
+			},
+		},
+		{
+			"+2 @Alice -2 @alice",
+			[]match{
+				{Value: 2, User: "Alice"},
+			},
+		},
+		{
+			"+1 @a +1 @b +1 @c +1 @d +1 @e",
+			[]match{
+				{Value: 1, User: "a"},
+				{Value: 1, User: "b"},
+				{Value: 1, User: "c"},
+			},
+		},
 	} {
 
 		out := matchMessage(tc.input)
@@ -87,3 +154,257 @@ func TestMatcher(t *testing.T) {
 		}
 	}
 }
+
+// Minimum precision and recall of the default grammar over the corpus. Raise
+// these as the grammar improves.
+const (
+	corpusMinPrecision = 1.0
+	corpusMinRecall    = 1.0
+)
+
+func TestMatcherCorpus(t *testing.T) {
+	f, err := os.Open("testdata/chat_corpus.tsv")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var tp, fp, fn, tn int
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		label, message, ok := strings.Cut(line, "\t")
+		if !ok || (label != "vote" && label != "none") {
+			t.Fatalf("malformed corpus line %q", line)
+		}
+
+		got := len(matchMessage(message)) > 0
+		switch {
+		case got && label == "vote":
+			tp++
+		case got:
+			fp++
+			t.Logf("false positive: %q -> %+v", message, matchMessage(message))
+		case label == "vote":
+			fn++
+			t.Logf("false negative: %q", message)
+		default:
+			tn++
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	precision := float64(tp) / float64(tp+fp)
+	recall := float64(tp) / float64(tp+fn)
+	t.Logf("corpus: %d lines, precision %.3f, recall %.3f", tp+fp+fn+tn, precision, recall)
+	if precision < corpusMinPrecision {
+		t.Errorf("precision %.3f below %.3f", precision, corpusMinPrecision)
+	}
+	if recall < corpusMinRecall {
+		t.Errorf("recall %.3f below %.3f", recall, corpusMinRecall)
+	}
+}
+
+type recordingSink struct {
+	transactions []Transaction
+}
+
+func (r *recordingSink) Insert(ctx context.Context, t Transaction) error {
+	r.transactions = append(r.transactions, t)
+	return nil
+}
+
+// fakeUserLookup answers user cache lookups by login or id from users.
+func fakeUserLookup(users ...*User) UserBatchLoadingFunction {
+	return func(ctx context.Context, keys []string) ([]*User, error) {
+		var found []*User
+		for _, key := range keys {
+			for _, u := range users {
+				if key == u.Login || key == u.ID {
+					found = append(found, u)
+					break
+				}
+			}
+		}
+		return found, nil
+	}
+}
+
+var testVoter = twitchirc.User{ID: "9", Name: "voter", DisplayName: "Voter"}
+
+// newTestChatHandler records the votes it accepts, looking up targets with
+// lookup.
+func newTestChatHandler(lookup UserBatchLoadingFunction) (*ChatHandler, *recordingSink) {
+	sink := &recordingSink{}
+	return &ChatHandler{
+		RootContext: context.Background(),
+		UserCache:   NewUserCache(10, lookup, lookup),
+		TSink:       sink,
+	}, sink
+}
+
+// sendChat sends message to the streamer's channel, without waiting on lookups.
+func sendChat(h *ChatHandler, user twitchirc.User, message string, reply *twitchirc.Reply) {
+	h.HandleMessage(twitchirc.PrivateMessage{
+		User:    user,
+		Message: message,
+		Channel: "streamer",
+		RoomID:  "1",
+		Reply:   reply,
+	})
+}
+
+func TestHandleMessageReply(t *testing.T) {
+	lookup := fakeUserLookup(&User{ID: "3", Login: "bob", DisplayName: "Bob"})
+
+	reply := &twitchirc.Reply{
+		ParentUserID:      "2",
+		ParentUserLogin:   "alice",
+		ParentDisplayName: "Alice",
+	}
+
+	for _, tc := range []struct {
+		message  string
+		reply    *twitchirc.Reply
+		expected []Transaction
+	}{
+		{"@Alice +2", reply, []Transaction{{TargetUser: "2", Value: 2, FromReply: true}}},
+		{"@alice +2 @bob", reply, []Transaction{{TargetUser: "3", Value: 2}}},
+		{"@alice -1 #topic", reply, []Transaction{{TargetTopic: "topic", Value: -1}}},
+		{"@alicex +2", reply, nil},
+		{"+2", nil, []Transaction{{TargetUser: "1", Value: 2}}},
+	} {
+		handler, sink := newTestChatHandler(lookup)
+		sendChat(handler, testVoter, tc.message, tc.reply)
+		handler.Wait()
+
+		for i := range tc.expected {
+			tc.expected[i].Channel = "1"
+			tc.expected[i].Source = "9"
+		}
+		if !cmp.Equal(sink.transactions, tc.expected) {
+			t.Errorf("%q did not match expected output\n%s", tc.message, cmp.Diff(sink.transactions, tc.expected))
+		}
+	}
+}
+
+func TestHandleMessageLookupFailures(t *testing.T) {
+	found := fakeUserLookup(&User{ID: "3", Login: "bob", DisplayName: "Bob"})
+	var calls, failures atomic.Int32
+	lookup := func(ctx context.Context, names []string) ([]*User, error) {
+		calls.Add(1)
+		if failures.Add(-1) >= 0 {
+			return nil, &twclient.APIError{StatusCode: http.StatusServiceUnavailable}
+		}
+		return found(ctx, names)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		message  string
+		failures int32
+		calls    int32
+		expected []Transaction
+	}{
+		{"unknown user is dropped", "@nobody +2", 0, 1, nil},
+		{"transient failure is retried", "@bob +2", 2, 3, []Transaction{{TargetUser: "3", Value: 2}}},
+		{"unknown user after failure", "@nobody +2", 1, 2, nil},
+		{"gives up eventually", "@bob +2", 100, voteRetryAttempts, nil},
+	} {
+		calls.Store(0)
+		failures.Store(tc.failures)
+		handler, sink := newTestChatHandler(lookup)
+		handler.RetryDelay = time.Millisecond
+		sendChat(handler, testVoter, tc.message, nil)
+		handler.Wait()
+
+		for i := range tc.expected {
+			tc.expected[i].Channel = "1"
+			tc.expected[i].Source = "9"
+		}
+		if !cmp.Equal(sink.transactions, tc.expected) {
+			t.Errorf("%s: did not match expected output\n%s", tc.name, cmp.Diff(sink.transactions, tc.expected))
+		}
+		if calls.Load() != tc.calls {
+			t.Errorf("%s: expected %d lookups, got %d", tc.name, tc.calls, calls.Load())
+		}
+	}
+}
+
+func TestHandleMessageOutage(t *testing.T) {
+	found := fakeUserLookup(&User{ID: "3", Login: "bob", DisplayName: "Bob"})
+	recovered := time.Now().Add(2 * time.Second)
+	handler, sink := newTestChatHandler(func(ctx context.Context, names []string) ([]*User, error) {
+		if time.Now().Before(recovered) {
+			return nil, &twclient.APIError{StatusCode: http.StatusServiceUnavailable}
+		}
+		return found(ctx, names)
+	})
+	handler.RetryDelay = 200 * time.Millisecond
+
+	// Longer than the twitch client's own retries last
+	sendChat(handler, testVoter, "@bob +2", nil)
+	handler.Wait()
+
+	expected := []Transaction{{Channel: "1", Source: "9", TargetUser: "3", Value: 2}}
+	if !cmp.Equal(sink.transactions, expected) {
+		t.Errorf("expected the vote to survive the outage\n%s", cmp.Diff(sink.transactions, expected))
+	}
+}
+
+func TestChatHandlerStop(t *testing.T) {
+	handler, sink := newTestChatHandler(func(ctx context.Context, names []string) ([]*User, error) {
+		return nil, &twclient.APIError{StatusCode: http.StatusServiceUnavailable}
+	})
+	handler.RetryDelay = time.Hour
+
+	sendChat(handler, testVoter, "@bob +2", nil)
+	handler.Stop()
+	// A second Stop is harmless
+	handler.Stop()
+
+	done := make(chan struct{})
+	go func() {
+		handler.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Wait did not return after Stop")
+	}
+	if len(sink.transactions) != 0 {
+		t.Errorf("expected no transactions, got %v", sink.transactions)
+	}
+}
+
+func TestHandleMessageUnicodeTarget(t *testing.T) {
+	var calls atomic.Int32
+	handler, sink := newTestChatHandler(func(ctx context.Context, names []string) ([]*User, error) {
+		calls.Add(1)
+		return nil, nil
+	})
+	vote := func(user twitchirc.User, message string) {
+		sendChat(handler, user, message, nil)
+		handler.Wait()
+	}
+
+	// Helix can't look up a display name, so don't ask it to
+	vote(testVoter, "+2 @안녕")
+	if len(sink.transactions) != 0 || calls.Load() != 0 {
+		t.Fatalf("expected the vote to be dropped without a lookup, got %v after %d lookups", sink.transactions, calls.Load())
+	}
+
+	// Once they've chatted the name is known
+	vote(twitchirc.User{ID: "5", Name: "annyeong", DisplayName: "안녕"}, "hello")
+	vote(testVoter, "+2 @안녕")
+	expected := []Transaction{{Channel: "1", Source: "9", TargetUser: "5", Value: 2}}
+	if !cmp.Equal(sink.transactions, expected) {
+		t.Errorf("did not match expected output\n%s", cmp.Diff(sink.transactions, expected))
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	twitchirc "github.com/gempir/go-twitch-irc/v4"
+)
+
+// ChatSayer is the subset of the irc client used to reply in chat.
+type ChatSayer interface {
+	Say(channel, text string)
+}
+
+// LedgerStore is the set of queries the chat commands need.
+type LedgerStore interface {
+	UserBalance(ctx context.Context, channel string, userID string) (*Balance, error)
+	TopicBalance(ctx context.Context, channel string, topic string) (*Balance, error)
+	Ledger(ctx context.Context, channel string, sourceID string) (*Balance, error)
+}
+
+type Command struct {
+	Name     string
+	Cooldown time.Duration
+	Run      func(ctx context.Context, m twitchirc.PrivateMessage, args []string) (string, error)
+}
+
+// CommandSettings customizes the commands for one channel.
+type CommandSettings struct {
+	// Enabled lists the commands allowed in the channel, all of them if nil.
+	Enabled []string
+	// Cooldowns overrides the default cooldown of a command.
+	Cooldowns map[string]time.Duration
+}
+
+type cooldownKey struct {
+	Command string
+	User    string
+}
+
+// CommandRouter dispatches !commands found in chat and replies with the result.
+type CommandRouter struct {
+	Sayer ChatSayer
+	// Channels holds per channel settings, keyed by channel name. Default
+	// applies to the rest.
+	Channels map[string]CommandSettings
+	Default  CommandSettings
+
+	commands map[string]*Command
+
+	cooldownMutex sync.Mutex
+	lastUsed      map[cooldownKey]time.Time
+	maxCooldown   time.Duration
+	lastSweep     time.Time
+}
+
+func NewCommandRouter(sayer ChatSayer) *CommandRouter {
+	return &CommandRouter{
+		Sayer:    sayer,
+		Channels: make(map[string]CommandSettings),
+		commands: make(map[string]*Command),
+		lastUsed: make(map[cooldownKey]time.Time),
+	}
+}
+
+func (r *CommandRouter) Register(cmd *Command) {
+	r.commands[cmd.Name] = cmd
+}
+
+// IsCommand reports whether the message invokes a command enabled in the
+// channel. Anything else, even starting with "!", is left for vote parsing.
+func (r *CommandRouter) IsCommand(channel string, message string) bool {
+	cmd, _ := r.match(channel, message)
+	return cmd != nil
+}
+
+// match finds the command invoked by message and its arguments.
+func (r *CommandRouter) match(channel string, message string) (*Command, []string) {
+	fields := strings.Fields(message)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "!") {
+		return nil, nil
+	}
+
+	cmd, ok := r.commands[strings.ToLower(strings.TrimPrefix(fields[0], "!"))]
+	if !ok {
+		return nil, nil
+	}
+	if enabled := r.settings(channel).Enabled; enabled != nil && !slices.Contains(enabled, cmd.Name) {
+		return nil, nil
+	}
+	return cmd, fields[1:]
+}
+
+func (r *CommandRouter) settings(channel string) CommandSettings {
+	if settings, ok := r.Channels[channel]; ok {
+		return settings
+	}
+	return r.Default
+}
+
+// Handle runs the command in the message, if any. It returns immediately and
+// replies asynchronously so a slow query doesn't stall chat processing.
+func (r *CommandRouter) Handle(ctx context.Context, m twitchirc.PrivateMessage) {
+	cmd, args := r.match(m.Channel, m.Message)
+	if cmd == nil {
+		return
+	}
+
+	cooldown := cmd.Cooldown
+	if c, ok := r.settings(m.Channel).Cooldowns[cmd.Name]; ok {
+		cooldown = c
+	}
+
+	if !r.takeCooldown(cmd.Name, cooldown, m.User.ID, m.Time) {
+		chatCommands.WithLabelValues(m.Channel, cmd.Name, "cooldown").Inc()
+		return
+	}
+
+	go func() {
+		reply, err := cmd.Run(ctx, m, args)
+		if err != nil {
+			chatCommands.WithLabelValues(m.Channel, cmd.Name, "error").Inc()
+			slog.Error("running command", "command", cmd.Name, "message", m.Message, "err", err)
+			return
+		}
+		chatCommands.WithLabelValues(m.Channel, cmd.Name, "ok").Inc()
+		if reply != "" {
+			r.Sayer.Say(m.Channel, reply)
+		}
+	}()
+}
+
+func (r *CommandRouter) takeCooldown(command string, cooldown time.Duration, user string, now time.Time) bool {
+	key := cooldownKey{Command: command, User: user}
+
+	r.cooldownMutex.Lock()
+	defer r.cooldownMutex.Unlock()
+	r.maxCooldown = max(r.maxCooldown, cooldown)
+	r.sweep(now)
+
+	if last, ok := r.lastUsed[key]; ok && now.Sub(last) < cooldown {
+		return false
+	}
+	r.lastUsed[key] = now
+	return true
+}
+
+// sweep drops uses older than the longest cooldown seen so the map doesn't
+// grow forever. Must be called with cooldownMutex held.
+func (r *CommandRouter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+
+	for k, last := range r.lastUsed {
+		if now.Sub(last) >= r.maxCooldown {
+			delete(r.lastUsed, k)
+		}
+	}
+}
+
+// ledgerCommands are the names registered by RegisterLedgerCommands.
+var ledgerCommands = []string{"balance", "ledger", "alignment"}
+
+// RegisterLedgerCommands adds !balance, !ledger and !alignment to the router.
+func RegisterLedgerCommands(r *CommandRouter, store LedgerStore, users *UserCache) {
+	r.Register(&Command{
+		Name:     "balance",
+		Cooldown: 30 * time.Second,
+		Run: func(ctx context.Context, m twitchirc.PrivateMessage, args []string) (string, error) {
+			name := m.User.DisplayName
+			var (
+				b   *Balance
+				err error
+			)
+			switch {
+			case len(args) > 0 && strings.HasPrefix(args[0], "#"):
+				name = args[0]
+				b, err = store.TopicBalance(ctx, m.RoomID, args[0][1:])
+			case len(args) > 0 && strings.HasPrefix(args[0], "@"):
+				u, uerr := users.GetByDisplayName(ctx, args[0][1:])
+				if uerr != nil {
+					return "", uerr
+				}
+				name = u.DisplayName
+				b, err = store.UserBalance(ctx, m.RoomID, u.ID)
+			default:
+				b, err = store.UserBalance(ctx, m.RoomID, m.User.ID)
+			}
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("@%s %s balance is %+d (+%d / %d)", m.User.DisplayName, name, b.Total, b.Positive, b.Negative), nil
+		},
+	})
+
+	r.Register(&Command{
+		Name:     "ledger",
+		Cooldown: 30 * time.Second,
+		Run: func(ctx context.Context, m twitchirc.PrivateMessage, args []string) (string, error) {
+			b, err := store.Ledger(ctx, m.RoomID, m.User.ID)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("@%s you have given +%d and %d", m.User.DisplayName, b.Positive, b.Negative), nil
+		},
+	})
+
+	r.Register(&Command{
+		Name:     "alignment",
+		Cooldown: 60 * time.Second,
+		Run: func(ctx context.Context, m twitchirc.PrivateMessage, args []string) (string, error) {
+			b, err := store.Ledger(ctx, m.RoomID, m.User.ID)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("@%s your alignment is %s", m.User.DisplayName, alignment(b)), nil
+		},
+	})
+}
+
+// alignment buckets how much of a ledger was spent upward vs downward.
+func alignment(b *Balance) string {
+	spent := b.Positive - b.Negative
+	if spent == 0 {
+		return "Unaligned"
+	}
+	score := float64(b.Positive+b.Negative) / float64(spent)
+	switch {
+	case score >= 0.6:
+		return "Benevolent"
+	case score >= 0.2:
+		return "Generous"
+	case score > -0.2:
+		return "Neutral"
+	case score > -0.6:
+		return "Critical"
+	default:
+		return "Malevolent"
+	}
+}
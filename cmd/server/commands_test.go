@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	twitchirc "github.com/gempir/go-twitch-irc/v4"
+)
+
+type chanSayer chan string
+
+func (s chanSayer) Say(channel, text string) {
+	s <- channel + ": " + text
+}
+
+type fakeLedger struct {
+	users  map[string]*Balance
+	topics map[string]*Balance
+	err    error
+}
+
+func (f *fakeLedger) UserBalance(ctx context.Context, channel string, userID string) (*Balance, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if b, ok := f.users[userID]; ok {
+		return b, nil
+	}
+	return &Balance{}, nil
+}
+
+func (f *fakeLedger) TopicBalance(ctx context.Context, channel string, topic string) (*Balance, error) {
+	if f.err != nil {
+		return nil, f.err
+	}
+	if b, ok := f.topics[topic]; ok {
+		return b, nil
+	}
+	return &Balance{}, nil
+}
+
+func (f *fakeLedger) Ledger(ctx context.Context, channel string, sourceID string) (*Balance, error) {
+	return &Balance{Total: 4, Positive: 6, Negative: -2}, nil
+}
+
+func TestIsCommand(t *testing.T) {
+	r := NewCommandRouter(chanSayer(make(chan string, 1)))
+	RegisterLedgerCommands(r, &fakeLedger{}, NewUserCache(10, nil, nil))
+	r.Channels["quiet"] = CommandSettings{Enabled: []string{"ledger"}}
+
+	for _, tc := range []struct {
+		channel  string
+		message  string
+		expected bool
+	}{
+		{"streamer", "!balance", true},
+		{"streamer", "!BALANCE @bob", true},
+		{"streamer", "!ledger", true},
+		{"streamer", "!lurk +2", false},
+		{"streamer", "! +2", false},
+		{"streamer", "balance", false},
+		{"streamer", "", false},
+		{"quiet", "!ledger", true},
+		{"quiet", "!balance +2", false},
+	} {
+		if got := r.IsCommand(tc.channel, tc.message); got != tc.expected {
+			t.Errorf("%s %q: expected %v got %v", tc.channel, tc.message, tc.expected, got)
+		}
+	}
+}
+
+func TestCommandReplies(t *testing.T) {
+	lookup := fakeUserLookup(&User{ID: "3", Login: "bob", DisplayName: "Bob"})
+
+	sayer := chanSayer(make(chan string, 1))
+	r := NewCommandRouter(sayer)
+	RegisterLedgerCommands(r, &fakeLedger{
+		users:  map[string]*Balance{"3": {Total: 5, Positive: 7, Negative: -2}},
+		topics: map[string]*Balance{"pizza": {Total: -1, Positive: 1, Negative: -2}},
+	}, NewUserCache(10, lookup, lookup))
+
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	// Each use is by a different voter so cooldowns don't get in the way
+	for i, tc := range []struct {
+		message  string
+		expected string
+	}{
+		{"!balance @bob", "streamer: @Voter Bob balance is +5 (+7 / -2)"},
+		{"!balance #pizza", "streamer: @Voter #pizza balance is -1 (+1 / -2)"},
+		{"!ledger", "streamer: @Voter you have given +6 and -2"},
+		{"!alignment", "streamer: @Voter your alignment is Generous"},
+	} {
+		r.Handle(context.Background(), twitchirc.PrivateMessage{
+			User:    twitchirc.User{ID: fmt.Sprint(100 + i), Name: "voter", DisplayName: "Voter"},
+			Message: tc.message,
+			Channel: "streamer",
+			RoomID:  "1",
+			Time:    now,
+		})
+		select {
+		case got := <-sayer:
+			if got != tc.expected {
+				t.Errorf("%q: expected reply %q got %q", tc.message, tc.expected, got)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("%q: no reply", tc.message)
+		}
+	}
+}
+
+func TestCommandCooldowns(t *testing.T) {
+	r := NewCommandRouter(nil)
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		name     string
+		user     string
+		cooldown time.Duration
+		at       time.Duration
+		expected bool
+	}{
+		{"first use", "a", 30 * time.Second, 0, true},
+		{"during cooldown", "a", 30 * time.Second, 10 * time.Second, false},
+		{"other user", "b", 30 * time.Second, 10 * time.Second, true},
+		{"after cooldown", "a", 30 * time.Second, 40 * time.Second, true},
+	} {
+		if got := r.takeCooldown("balance", tc.cooldown, tc.user, now.Add(tc.at)); got != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, got)
+		}
+	}
+
+	// Uses past the longest cooldown are swept
+	r.takeCooldown("balance", 30*time.Second, "c", now.Add(10*time.Minute))
+	if len(r.lastUsed) != 1 {
+		t.Errorf("expected expired cooldowns to be swept, have %d", len(r.lastUsed))
+	}
+}
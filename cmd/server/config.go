@@ -0,0 +1,353 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is everything needed to run the server. It's loaded from a YAML file
+// and then overridden by the environment variables noted on each field.
+type Config struct {
+	Port       string `yaml:"port"`        // PORT
+	PromPort   string `yaml:"prom_port"`   // PROM_PORT
+	AdminToken string `yaml:"admin_token"` // ADMIN_TOKEN
+	FakeData   bool   `yaml:"fake_data"`
+
+	ClickHouse ClickHouseConfig `yaml:"clickhouse"`
+	Twitch     TwitchConfig     `yaml:"twitch"`
+	Sink       SinkConfig       `yaml:"sink"`
+	Stream     StreamConfig     `yaml:"stream"`
+	Health     HealthConfig     `yaml:"health"`
+
+	UserCacheSize int `yaml:"user_cache_size"`
+
+	// BotLogins and BotBadges mark accounts that never vote or get voted on.
+	// Setting either replaces the default list.
+	BotLogins []string `yaml:"bot_logins"`
+	BotBadges []string `yaml:"bot_badges"`
+
+	// SeedChannels are joined on first start, after that the admin api
+	// manages the channel list.
+	SeedChannels []string `yaml:"seed_channels"`
+
+	// Defaults apply to every channel, Channels overrides them by name.
+	Defaults ChannelConfig            `yaml:"defaults"`
+	Channels map[string]ChannelConfig `yaml:"channels"`
+}
+
+type ClickHouseConfig struct {
+	Addr     string `yaml:"addr"`     // CH_ADDR
+	Database string `yaml:"database"` // CH_DATABASE
+	User     string `yaml:"user"`     // CH_USER
+	Password string `yaml:"password"` // CH_PASSWORD
+}
+
+type TwitchConfig struct {
+	ClientID     string `yaml:"client_id"`     // TWITCH_CLIENT_ID
+	ClientSecret string `yaml:"client_secret"` // TWITCH_SECRET
+	OAuth        string `yaml:"oauth"`         // TWITCH_OAUTH
+	BotAccount   string `yaml:"bot_account"`   // TWITCH_BOT_ACCOUNT
+	// HelixURL and OAuthURL point the api client somewhere other than twitch,
+	// like a twitchtest server.
+	HelixURL string `yaml:"helix_url"` // TWITCH_HELIX_URL
+	OAuthURL string `yaml:"oauth_url"` // TWITCH_OAUTH_URL
+}
+
+type SinkConfig struct {
+	// WALDir enables the on-disk write-ahead log when set. WAL_DIR
+	WALDir        string        `yaml:"wal_dir"`
+	WALMaxBytes   int64         `yaml:"wal_max_bytes"`
+	WALOverflow   string        `yaml:"wal_overflow"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	BatchSize     int           `yaml:"batch_size"`
+	QueueSize     int           `yaml:"queue_size"`
+}
+
+type StreamConfig struct {
+	BufferSize       int           `yaml:"buffer_size"`
+	Overflow         string        `yaml:"overflow"`
+	HistorySize      int           `yaml:"history_size"`
+	Heartbeat        time.Duration `yaml:"heartbeat"`
+	MaxSubscriptions int           `yaml:"max_subscriptions"`
+}
+
+type HealthConfig struct {
+	// MaxBacklog is how many transactions can wait in the sink before /readyz
+	// reports degraded.
+	MaxBacklog  int           `yaml:"max_backlog"`
+	PingTimeout time.Duration `yaml:"ping_timeout"`
+}
+
+// ChannelConfig holds the per channel settings. Unset fields fall back to
+// Config.Defaults, including the fields of Grammar.
+type ChannelConfig struct {
+	Grammar *VoteGrammar `yaml:"grammar"`
+	// RateLimit is how often a user can vote on the same target.
+	RateLimit *time.Duration `yaml:"rate_limit"`
+	// Commands lists the enabled chat commands, all of them if unset.
+	Commands []string `yaml:"commands"`
+	// CommandCooldowns overrides the per user cooldown of a command.
+	CommandCooldowns map[string]time.Duration `yaml:"command_cooldowns"`
+}
+
+var (
+	walOverflowPolicies = map[string]WALOverflowPolicy{
+		"reject_new":  WALRejectNew,
+		"drop_oldest": WALDropOldest,
+	}
+	streamOverflowPolicies = map[string]OverflowPolicy{
+		DropOldest.String(): DropOldest,
+		DropNewest.String(): DropNewest,
+		Disconnect.String(): Disconnect,
+	}
+)
+
+func DefaultConfig() *Config {
+	rateLimit := 30 * time.Second
+	grammar := DefaultVoteGrammar
+	return &Config{
+		Port:     "8080",
+		PromPort: "9091",
+		ClickHouse: ClickHouseConfig{
+			Addr:     "localhost:9000",
+			Database: "pulse",
+		},
+		Twitch: TwitchConfig{
+			BotAccount: "shindaggers",
+			HelixURL:   twclient.DefaultHelixURL,
+			OAuthURL:   twclient.DefaultOAuthURL,
+		},
+		Sink: SinkConfig{
+			WALMaxBytes:   1 << 30,
+			WALOverflow:   "reject_new",
+			FlushInterval: 5 * time.Second,
+			BatchSize:     1000,
+			QueueSize:     10000,
+		},
+		Stream: StreamConfig{
+			BufferSize:       64,
+			Overflow:         DropOldest.String(),
+			HistorySize:      256,
+			Heartbeat:        15 * time.Second,
+			MaxSubscriptions: 50,
+		},
+		Health: HealthConfig{
+			MaxBacklog:  5000,
+			PingTimeout: 2 * time.Second,
+		},
+		UserCacheSize: 10000,
+		BotLogins:     slices.Clone(DefaultBotLogins),
+		BotBadges:     slices.Clone(DefaultBotBadges),
+		SeedChannels: []string{
+			"shindaggers",
+			"shindigs",
+			"jamsvirtual",
+			"northernlion",
+			"chiblee",
+			"HCJustin",
+			"michaelalfox",
+			"flackblag",
+			"dumbdog",
+			"baertaffy",
+			"dangheesling",
+		},
+		Defaults: ChannelConfig{
+			Grammar:   &grammar,
+			RateLimit: &rateLimit,
+		},
+	}
+}
+
+// LoadConfig reads the YAML file at path, if any, over the defaults, applies
+// environment overrides and validates the result.
+func LoadConfig(path string) (*Config, error) {
+	cfg := DefaultConfig()
+
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, fmt.Errorf("opening config: %w", err)
+		}
+		defer f.Close()
+
+		dec := yaml.NewDecoder(f)
+		dec.KnownFields(true)
+		if err := dec.Decode(cfg); err != nil {
+			return nil, fmt.Errorf("decoding config %s: %w", path, err)
+		}
+	}
+
+	// Chat reports channel names lower cased
+	channels := make(map[string]ChannelConfig, len(cfg.Channels))
+	for name, ch := range cfg.Channels {
+		channels[strings.ToLower(name)] = ch
+	}
+	cfg.Channels = channels
+
+	cfg.applyEnv(os.LookupEnv)
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) applyEnv(lookup func(string) (string, bool)) {
+	for env, field := range map[string]*string{
+		"PORT":               &c.Port,
+		"PROM_PORT":          &c.PromPort,
+		"ADMIN_TOKEN":        &c.AdminToken,
+		"CH_ADDR":            &c.ClickHouse.Addr,
+		"CH_DATABASE":        &c.ClickHouse.Database,
+		"CH_USER":            &c.ClickHouse.User,
+		"CH_PASSWORD":        &c.ClickHouse.Password,
+		"TWITCH_CLIENT_ID":   &c.Twitch.ClientID,
+		"TWITCH_SECRET":      &c.Twitch.ClientSecret,
+		"TWITCH_OAUTH":       &c.Twitch.OAuth,
+		"TWITCH_BOT_ACCOUNT": &c.Twitch.BotAccount,
+		"TWITCH_HELIX_URL":   &c.Twitch.HelixURL,
+		"TWITCH_OAUTH_URL":   &c.Twitch.OAuthURL,
+		"WAL_DIR":            &c.Sink.WALDir,
+	} {
+		if v, ok := lookup(env); ok && v != "" {
+			*field = v
+		}
+	}
+}
+
+// Validate reports every problem with the config at once.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+
+	for _, port := range []struct{ name, value string }{
+		{"port", c.Port},
+		{"prom_port", c.PromPort},
+	} {
+		p, err := strconv.Atoi(port.value)
+		check(err == nil && p > 0 && p < 65536, "%s %q is not a valid port", port.name, port.value)
+	}
+	check(c.ClickHouse.Addr != "", "clickhouse.addr is required")
+	check(c.ClickHouse.Database != "", "clickhouse.database is required")
+	check(c.Twitch.ClientID != "", "twitch.client_id is required")
+	check(c.Twitch.ClientSecret != "", "twitch.client_secret is required")
+	check(c.Twitch.BotAccount != "", "twitch.bot_account is required")
+	for _, u := range []struct{ name, value string }{
+		{"twitch.helix_url", c.Twitch.HelixURL},
+		{"twitch.oauth_url", c.Twitch.OAuthURL},
+	} {
+		parsed, err := url.Parse(u.value)
+		check(err == nil && parsed.Scheme != "" && parsed.Host != "", "%s %q is not a valid url", u.name, u.value)
+	}
+	check(c.UserCacheSize > 0, "user_cache_size must be positive")
+	for _, login := range c.BotLogins {
+		check(validLogin.MatchString(strings.ToLower(login)), "bot_logins: %q is not a valid twitch login", login)
+	}
+	for _, badge := range c.BotBadges {
+		check(badge != "" && !strings.ContainsAny(badge, " \t,/"), "bot_badges: %q is not a valid badge name", badge)
+	}
+
+	_, ok := walOverflowPolicies[c.Sink.WALOverflow]
+	check(ok, "sink.wal_overflow %q must be reject_new or drop_oldest", c.Sink.WALOverflow)
+	check(c.Sink.WALMaxBytes >= 0, "sink.wal_max_bytes must not be negative")
+	check(c.Sink.FlushInterval > 0, "sink.flush_interval must be positive")
+	check(c.Sink.BatchSize > 0, "sink.batch_size must be positive")
+	check(c.Sink.QueueSize > 0, "sink.queue_size must be positive")
+
+	_, ok = streamOverflowPolicies[c.Stream.Overflow]
+	check(ok, "stream.overflow %q must be drop_oldest, drop_newest or disconnect", c.Stream.Overflow)
+	check(c.Stream.BufferSize > 0, "stream.buffer_size must be positive")
+	check(c.Stream.HistorySize >= 0, "stream.history_size must not be negative")
+	check(c.Stream.Heartbeat > 0, "stream.heartbeat must be positive")
+	check(c.Stream.MaxSubscriptions > 0, "stream.max_subscriptions must be positive")
+
+	check(c.Health.MaxBacklog > 0, "health.max_backlog must be positive")
+	check(c.Health.PingTimeout > 0, "health.ping_timeout must be positive")
+
+	check(c.Defaults.Grammar != nil, "defaults.grammar is required")
+	check(c.Defaults.RateLimit != nil, "defaults.rate_limit is required")
+	errs = append(errs, c.Defaults.validate("defaults")...)
+	if c.Defaults.Grammar != nil {
+		if _, err := NewRuleParser(*c.Defaults.Grammar); err != nil {
+			errs = append(errs, fmt.Errorf("defaults.grammar: %w", err))
+		}
+	}
+	names := make([]string, 0, len(c.Channels))
+	for name := range c.Channels {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	for _, name := range names {
+		path := "channels." + name
+		errs = append(errs, c.Channels[name].validate(path)...)
+		// Channel grammars only need the fields that differ from the defaults
+		if c.Channels[name].Grammar != nil {
+			if _, err := NewRuleParser(*c.Channel(name).Grammar); err != nil {
+				errs = append(errs, fmt.Errorf("%s.grammar: %w", path, err))
+			}
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (c ChannelConfig) validate(path string) []error {
+	var errs []error
+	if c.RateLimit != nil && *c.RateLimit < 0 {
+		errs = append(errs, fmt.Errorf("%s.rate_limit must not be negative", path))
+	}
+	for _, cmd := range c.Commands {
+		if !slices.Contains(ledgerCommands, cmd) {
+			errs = append(errs, fmt.Errorf("%s.commands: unknown command %q", path, cmd))
+		}
+	}
+	for cmd, cooldown := range c.CommandCooldowns {
+		if !slices.Contains(ledgerCommands, cmd) {
+			errs = append(errs, fmt.Errorf("%s.command_cooldowns: unknown command %q", path, cmd))
+		}
+		if cooldown < 0 {
+			errs = append(errs, fmt.Errorf("%s.command_cooldowns.%s must not be negative", path, cmd))
+		}
+	}
+	return errs
+}
+
+// Channel returns the settings for a channel with defaults filled in.
+func (c *Config) Channel(name string) ChannelConfig {
+	merged := c.Defaults
+	ch, ok := c.Channels[strings.ToLower(name)]
+	if !ok {
+		return merged
+	}
+	if ch.Grammar != nil {
+		g := *ch.Grammar
+		if merged.Grammar != nil {
+			g = g.merge(*merged.Grammar)
+		}
+		merged.Grammar = &g
+	}
+	if ch.RateLimit != nil {
+		merged.RateLimit = ch.RateLimit
+	}
+	if ch.Commands != nil {
+		merged.Commands = ch.Commands
+	}
+	if ch.CommandCooldowns != nil {
+		merged.CommandCooldowns = ch.CommandCooldowns
+	}
+	return merged
+}
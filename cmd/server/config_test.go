@@ -0,0 +1,208 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	t.Setenv("TWITCH_SECRET", "from-env")
+	t.Setenv("PORT", "")
+
+	cfg, err := LoadConfig(writeConfig(t, `
+port: "8081"
+twitch:
+  client_id: abc
+  client_secret: from-file
+bot_logins: [nightbot, MyBot]
+defaults:
+  commands: [balance, ledger]
+channels:
+  NorthernLion:
+    rate_limit: 1m
+    grammar:
+      keywords:
+        KEKW: 1
+    command_cooldowns:
+      balance: 2m
+  lirik:
+    grammar:
+      topic_sigils: "$"
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Port != "8081" {
+		t.Errorf("empty env var should not override the file, got port %q", cfg.Port)
+	}
+	if cfg.Twitch.ClientSecret != "from-env" {
+		t.Errorf("env var should override the file, got secret %q", cfg.Twitch.ClientSecret)
+	}
+	if cfg.Twitch.BotAccount != "shindaggers" {
+		t.Errorf("expected default bot account, got %q", cfg.Twitch.BotAccount)
+	}
+	if !cmp.Equal(cfg.BotLogins, []string{"nightbot", "MyBot"}) {
+		t.Errorf("expected the file to replace the bot logins, got %v", cfg.BotLogins)
+	}
+	if !cmp.Equal(cfg.BotBadges, DefaultBotBadges) {
+		t.Errorf("expected default bot badges, got %v", cfg.BotBadges)
+	}
+
+	nl := cfg.Channel("northernlion")
+	if *nl.RateLimit != time.Minute {
+		t.Errorf("expected channel rate limit of 1m, got %s", *nl.RateLimit)
+	}
+	// Only the keywords are overridden, the rest comes from the defaults
+	expected := DefaultVoteGrammar
+	expected.Keywords = map[string]int{"KEKW": 1}
+	if !cmp.Equal(*nl.Grammar, expected) {
+		t.Errorf("unexpected channel grammar\n%s", cmp.Diff(*nl.Grammar, expected))
+	}
+	p, err := NewRuleParser(*nl.Grammar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range []string{"+2", "KEKW"} {
+		if got := p.Parse(m); len(got) != 1 {
+			t.Errorf("expected %q to parse with the merged grammar, got %v", m, got)
+		}
+	}
+	if !cmp.Equal(nl.Commands, []string{"balance", "ledger"}) {
+		t.Errorf("expected default commands, got %v", nl.Commands)
+	}
+	if nl.CommandCooldowns["balance"] != 2*time.Minute {
+		t.Errorf("expected balance cooldown of 2m, got %v", nl.CommandCooldowns)
+	}
+
+	// A grammar without magnitudes or keywords is fine once merged
+	lirik := cfg.Channel("lirik")
+	if lirik.Grammar.TopicSigils != "$" || !cmp.Equal(lirik.Grammar.Magnitudes, DefaultVoteGrammar.Magnitudes) {
+		t.Errorf("unexpected channel grammar %+v", lirik.Grammar)
+	}
+
+	other := cfg.Channel("shindigs")
+	if *other.RateLimit != 30*time.Second {
+		t.Errorf("expected default rate limit, got %s", *other.RateLimit)
+	}
+	if !cmp.Equal(*other.Grammar, DefaultVoteGrammar) {
+		t.Errorf("expected default grammar, got %+v", other.Grammar)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		want []string
+	}{
+		{
+			name: "unknown field",
+			body: "prot: 8080\n",
+			want: []string{"field prot not found"},
+		},
+		{
+			name: "every problem is reported",
+			body: `
+port: "http"
+twitch:
+  client_id: abc
+  client_secret: def
+sink:
+  wal_overflow: sometimes
+bot_logins: ["night bot"]
+bot_badges: ["", "bot-badge/1"]
+channels:
+  shindigs:
+    grammar:
+      magnitudes: [500]
+    commands: [balance, dance]
+`,
+			want: []string{
+				`port "http" is not a valid port`,
+				`sink.wal_overflow "sometimes"`,
+				`bot_logins: "night bot" is not a valid twitch login`,
+				`bot_badges: "" is not a valid badge name`,
+				`bot_badges: "bot-badge/1" is not a valid badge name`,
+				"channels.shindigs.grammar: magnitude 500 out of range",
+				`channels.shindigs.commands: unknown command "dance"`,
+			},
+		},
+		{
+			name: "missing credentials",
+			body: "port: \"8080\"\n",
+			want: []string{"twitch.client_id is required", "twitch.client_secret is required"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			t.Setenv("TWITCH_CLIENT_ID", "")
+			t.Setenv("TWITCH_SECRET", "")
+
+			_, err := LoadConfig(writeConfig(t, tc.body))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("expected error to contain %q, got:\n%s", want, err)
+				}
+			}
+		})
+	}
+}
+
+func TestLoadConfigTwitchURLs(t *testing.T) {
+	t.Setenv("TWITCH_HELIX_URL", "")
+	t.Setenv("TWITCH_OAUTH_URL", "")
+
+	body := `
+twitch:
+  client_id: abc
+  client_secret: def
+  helix_url: http://localhost:9090/helix
+  oauth_url: http://localhost:9090/oauth2
+`
+	cfg, err := LoadConfig(writeConfig(t, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Twitch.HelixURL != "http://localhost:9090/helix" || cfg.Twitch.OAuthURL != "http://localhost:9090/oauth2" {
+		t.Errorf("expected urls from the file, got %q and %q", cfg.Twitch.HelixURL, cfg.Twitch.OAuthURL)
+	}
+
+	t.Setenv("TWITCH_HELIX_URL", "http://twitchtest/helix")
+	t.Setenv("TWITCH_OAUTH_URL", "http://twitchtest/oauth2")
+	cfg, err = LoadConfig(writeConfig(t, body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Twitch.HelixURL != "http://twitchtest/helix" || cfg.Twitch.OAuthURL != "http://twitchtest/oauth2" {
+		t.Errorf("expected env vars to override the file, got %q and %q", cfg.Twitch.HelixURL, cfg.Twitch.OAuthURL)
+	}
+
+	t.Setenv("TWITCH_HELIX_URL", "localhost:9090")
+	t.Setenv("TWITCH_OAUTH_URL", "/oauth2")
+	_, err = LoadConfig(writeConfig(t, body))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	expected := `twitch.helix_url "localhost:9090" is not a valid url` + "\n" +
+		`twitch.oauth_url "/oauth2" is not a valid url`
+	if !strings.Contains(err.Error(), expected) {
+		t.Errorf("expected both urls to be reported in order, got:\n%s", err)
+	}
+}
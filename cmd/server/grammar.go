@@ -0,0 +1,286 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// VoteParser extracts the votes from a chat message, returning none if there
+// aren't any.
+type VoteParser interface {
+	Parse(message string) []match
+}
+
+// VoteGrammar configures a RuleParser.
+type VoteGrammar struct {
+	// Magnitudes are the allowed absolute values of a +n/-n vote.
+	Magnitudes []int `yaml:"magnitudes"`
+	// UserSigils prefix a user target, e.g. "@".
+	UserSigils string `yaml:"user_sigils"`
+	// TopicSigils prefix a topic target, e.g. "#".
+	TopicSigils string `yaml:"topic_sigils"`
+	// Keywords map whole words, usually emotes, to a vote value.
+	Keywords map[string]int `yaml:"keywords"`
+	// MaxVotes caps how many votes one message can cast. Defaults to 3.
+	MaxVotes int `yaml:"max_votes"`
+}
+
+const defaultMaxVotes = 3
+
+// merge fills in the fields g leaves unset from base.
+func (g VoteGrammar) merge(base VoteGrammar) VoteGrammar {
+	if g.Magnitudes == nil {
+		g.Magnitudes = base.Magnitudes
+	}
+	if g.UserSigils == "" {
+		g.UserSigils = base.UserSigils
+	}
+	if g.TopicSigils == "" {
+		g.TopicSigils = base.TopicSigils
+	}
+	if g.Keywords == nil {
+		g.Keywords = base.Keywords
+	}
+	if g.MaxVotes == 0 {
+		g.MaxVotes = base.MaxVotes
+	}
+	return g
+}
+
+// DefaultVoteGrammar is the classic +2/-2 grammar.
+var DefaultVoteGrammar = VoteGrammar{
+	Magnitudes:  []int{1, 2},
+	UserSigils:  "@",
+	TopicSigils: "#",
+}
+
+// RuleParser parses votes according to a VoteGrammar.
+type RuleParser struct {
+	grammar       VoteGrammar
+	numberMatcher *regexp.Regexp
+	targetMatcher *regexp.Regexp
+}
+
+func NewRuleParser(g VoteGrammar) (*RuleParser, error) {
+	if len(g.Magnitudes) == 0 && len(g.Keywords) == 0 {
+		return nil, fmt.Errorf("grammar needs magnitudes or keywords")
+	}
+	for _, m := range g.Magnitudes {
+		if m <= 0 || m > 127 {
+			return nil, fmt.Errorf("magnitude %d out of range", m)
+		}
+	}
+	if g.MaxVotes < 0 {
+		return nil, fmt.Errorf("max votes must not be negative")
+	}
+	if g.MaxVotes == 0 {
+		g.MaxVotes = defaultMaxVotes
+	}
+	for k, v := range g.Keywords {
+		if v == 0 || v > 127 || v < -127 {
+			return nil, fmt.Errorf("keyword %q value %d out of range", k, v)
+		}
+	}
+
+	p := &RuleParser{
+		grammar: g,
+		// A value must be the whole word, allowing for surrounding punctuation
+		// like "(+2)" or "+2!!". This rejects "3+2-1", "UTC+2" and "+2.5".
+		numberMatcher: regexp.MustCompile(`^[("'\[]?([+-][0-9]+)[)"'\].,!?;~]*$`),
+	}
+
+	sigils := g.UserSigils + g.TopicSigils
+	if sigils != "" {
+		// A target must start the word, so "me@example.com" isn't one. Names
+		// can be any letters, marks, digits or underscores, e.g. #pokémon,
+		// @user_123 or #原神.
+		p.targetMatcher = regexp.MustCompile(`^[("'\[]?([` + quoteClass(sigils) + `])([\p{L}\p{M}\p{N}_]+)`)
+	}
+	return p, nil
+}
+
+// quoteClass escapes s for use inside a regexp character class. QuoteMeta
+// leaves "-" alone, which would turn sigils like "@-#" into a range.
+func quoteClass(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		if strings.ContainsRune(`\]^-[`, r) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+type voteToken struct {
+	Pos   int
+	Value int
+	User  string
+	Topic string
+}
+
+func (t voteToken) isTarget() bool {
+	return t.Value == 0
+}
+
+// tokens finds every allowed value and target in the message, in order. Pos
+// is the index of the word the token came from.
+func (p *RuleParser) tokens(m string) []voteToken {
+	words := strings.Fields(m)
+
+	var toks []voteToken
+	for i, word := range words {
+		if looksLikeURL(word) {
+			continue
+		}
+
+		if val, ok := p.grammar.Keywords[word]; ok {
+			toks = append(toks, voteToken{Pos: i, Value: val})
+			continue
+		}
+
+		if sm := p.numberMatcher.FindStringSubmatch(word); sm != nil {
+			val, err := strconv.Atoi(sm[1])
+			if err == nil && slices.Contains(p.grammar.Magnitudes, abs(val)) && !inNumericContext(words, i) {
+				toks = append(toks, voteToken{Pos: i, Value: val})
+			}
+			continue
+		}
+
+		if p.targetMatcher != nil {
+			if sm := p.targetMatcher.FindStringSubmatch(word); sm != nil {
+				tok := voteToken{Pos: i}
+				if strings.Contains(p.grammar.UserSigils, sm[1]) {
+					tok.User = norm.NFC.String(sm[2])
+				} else {
+					tok.Topic = normalizeName(sm[2])
+				}
+				toks = append(toks, tok)
+			}
+		}
+	}
+	return toks
+}
+
+// normalizeName puts a user name or topic in its canonical form, NFC then
+// lowercased. It must agree with lowerUTF8(normalizeUTF8NFC(...)) in
+// clickhouse, so rows written before topics were normalized are still found.
+// That's why it lowercases rather than case folds: "Straße" and "STRASSE" stay
+// different topics.
+func normalizeName(name string) string {
+	return strings.ToLower(norm.NFC.String(name))
+}
+
+func looksLikeURL(word string) bool {
+	return strings.Contains(word, "://") || strings.HasPrefix(strings.ToLower(word), "www.")
+}
+
+// inNumericContext reports whether the value at words[i] is part of something
+// numeric rather than a vote, like a phone number "+1 555 123 4567" or sum
+// "2 +2 = 4".
+func inNumericContext(words []string, i int) bool {
+	if i+1 < len(words) {
+		next := strings.TrimLeft(words[i+1], "(")
+		if next == "=" || (next != "" && next[0] >= '0' && next[0] <= '9') {
+			return true
+		}
+	}
+	if i > 0 {
+		prev := words[i-1]
+		if strings.HasSuffix(prev, "=") || isNumeric(prev) {
+			return true
+		}
+	}
+	return false
+}
+
+func isNumeric(word string) bool {
+	if word == "" {
+		return false
+	}
+	for _, r := range word {
+		if (r < '0' || r > '9') && r != '.' && r != ',' {
+			return false
+		}
+	}
+	return true
+}
+
+// Parse pairs each value with a target. If the message leads with a value
+// ("+2 @alice -2 @bob") each value takes the next target before the following
+// value; if it leads with a target ("@alice +2 @bob -2") each value takes the
+// closest target before it. Values without a target go to the streamer. Only
+// the first vote for each target counts, and at most MaxVotes are returned.
+func (p *RuleParser) Parse(m string) []match {
+	toks := p.tokens(m)
+	if len(toks) == 0 {
+		return nil
+	}
+	targetsFirst := toks[0].isTarget()
+
+	var (
+		matches []match
+		open    = -1
+		last    *voteToken
+	)
+	for i, tok := range toks {
+		switch {
+		case tok.isTarget() && targetsFirst:
+			last = &toks[i]
+		case tok.isTarget():
+			if open >= 0 {
+				matches[open].User, matches[open].Topic = tok.User, tok.Topic
+				open = -1
+			}
+		case targetsFirst:
+			ma := match{Value: tok.Value}
+			if last != nil {
+				ma.User, ma.Topic = last.User, last.Topic
+			}
+			matches = append(matches, ma)
+		default:
+			matches = append(matches, match{Value: tok.Value})
+			open = len(matches) - 1
+		}
+	}
+
+	var votes []match
+	seen := make(map[match]bool)
+	for _, ma := range matches {
+		// Names differing only in case are the same user
+		target := match{User: normalizeName(ma.User), Topic: ma.Topic}
+		if seen[target] {
+			continue
+		}
+		seen[target] = true
+		votes = append(votes, ma)
+		if len(votes) >= p.grammar.MaxVotes {
+			break
+		}
+	}
+	return votes
+}
+
+func abs(v int) int {
+	if v < 0 {
+		return -v
+	}
+	return v
+}
+
+var defaultParser = func() *RuleParser {
+	p, err := NewRuleParser(DefaultVoteGrammar)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}()
+
+func matchMessage(m string) []match {
+	return defaultParser.Parse(m)
+}
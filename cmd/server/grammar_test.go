@@ -0,0 +1,101 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRuleParser(t *testing.T) {
+	p, err := NewRuleParser(VoteGrammar{
+		Magnitudes:  []int{1, 2, 3, 4, 5},
+		UserSigils:  "@",
+		TopicSigils: "#$",
+		Keywords: map[string]int{
+			"KEKW":  1,
+			"Sadge": -1,
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected []match
+	}{
+		{"+5 @user", []match{{Value: 5, User: "user"}}},
+		{"-3 $topic", []match{{Value: -3, Topic: "topic"}}},
+		{"+6", nil},
+		{"+9 +4", []match{{Value: 4}}},
+		{"KEKW", []match{{Value: 1}}},
+		{"Sadge @user", []match{{Value: -1, User: "user"}}},
+		{"kekw", nil},
+		{"KEKWait", nil},
+	} {
+		out := p.Parse(tc.input)
+		if !cmp.Equal(out, tc.expected) {
+			t.Errorf("%q did not match expected output\n%s", tc.input, cmp.Diff(out, tc.expected))
+		}
+	}
+}
+
+func TestRuleParserSigilClass(t *testing.T) {
+	// Class metacharacters are taken literally, "@-#" is not a range
+	p, err := NewRuleParser(VoteGrammar{
+		Magnitudes:  []int{1, 2},
+		UserSigils:  "@",
+		TopicSigils: "-#^]",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		input    string
+		expected []match
+	}{
+		{"+2 -pizza", []match{{Value: 2, Topic: "pizza"}}},
+		{"+2 ^pizza", []match{{Value: 2, Topic: "pizza"}}},
+		{"+2 ]pizza", []match{{Value: 2, Topic: "pizza"}}},
+		{"-2 @user", []match{{Value: -2, User: "user"}}},
+		{"+2 Apizza", []match{{Value: 2}}},
+		{"+2 $pizza", []match{{Value: 2}}},
+	} {
+		out := p.Parse(tc.input)
+		if !cmp.Equal(out, tc.expected) {
+			t.Errorf("%q did not match expected output\n%s", tc.input, cmp.Diff(out, tc.expected))
+		}
+	}
+}
+
+func TestRuleParserValidation(t *testing.T) {
+	for _, g := range []VoteGrammar{
+		{},
+		{Magnitudes: []int{0}},
+		{Magnitudes: []int{200}},
+		{Keywords: map[string]int{"KEKW": 0}},
+	} {
+		if _, err := NewRuleParser(g); err == nil {
+			t.Errorf("expected %+v to be rejected", g)
+		}
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	// Each matches lowerUTF8(normalizeUTF8NFC(...)) in clickhouse
+	for _, tc := range []struct {
+		name, expected string
+	}{
+		{"Pokémon", "pokémon"},
+		{"Poke\u0301mon", "pokémon"},
+		{"Straße", "straße"},
+		{"STRASSE", "strasse"},
+		{"ΣΊΣΥΦΟΣ", "σίσυφοσ"},
+		{"原神", "原神"},
+	} {
+		if got := normalizeName(tc.name); got != tc.expected {
+			t.Errorf("expected %q to normalize to %q, got %q", tc.name, tc.expected, got)
+		}
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	twitchirc "github.com/gempir/go-twitch-irc/v4"
+)
+
+// IRCStatus follows the irc connection through the client callbacks.
+type IRCStatus struct {
+	mu          sync.Mutex
+	connected   bool
+	since       time.Time
+	joined      map[string]bool
+	pingSent    time.Time // zero once answered
+	pongTimeout time.Duration
+}
+
+func NewIRCStatus() *IRCStatus {
+	return &IRCStatus{joined: make(map[string]bool)}
+}
+
+// Watch registers the callbacks on the client. The client only takes one
+// OnConnect callback, so that one has to call Connected itself.
+//
+// The client reconnects a dropped connection without telling us, but it pings
+// the server whenever the connection goes idle and gives up on it after
+// PongTimeout. A ping left unanswered for longer than that means we're cut off.
+func (s *IRCStatus) Watch(c *twitchirc.Client) {
+	s.mu.Lock()
+	s.pongTimeout = c.PongTimeout
+	s.mu.Unlock()
+
+	c.OnReconnectMessage(func(twitchirc.ReconnectMessage) {
+		s.Disconnected()
+	})
+	c.OnPingSent(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if s.pingSent.IsZero() {
+			s.pingSent = time.Now()
+		}
+	})
+	c.OnPongMessage(func(twitchirc.PongMessage) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.pingSent = time.Time{}
+	})
+	c.OnSelfJoinMessage(func(m twitchirc.UserJoinMessage) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.joined[m.Channel] = true
+	})
+	c.OnSelfPartMessage(func(m twitchirc.UserPartMessage) {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		delete(s.joined, m.Channel)
+	})
+}
+
+// Connected records a successful login. Channels are joined again on every
+// login, so whatever we were in before doesn't count any more.
+func (s *IRCStatus) Connected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = true
+	s.since = time.Now()
+	s.pingSent = time.Time{}
+	clear(s.joined)
+}
+
+// Disconnected records that twitch asked us to reconnect, channels will be
+// joined again once we have.
+func (s *IRCStatus) Disconnected() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.connected = false
+	s.since = time.Now()
+	clear(s.joined)
+}
+
+func (s *IRCStatus) snapshot() (connected bool, since time.Time, joined map[string]bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	connected, since = s.connected, s.since
+	if connected && s.pongTimeout > 0 && !s.pingSent.IsZero() {
+		if lost := s.pingSent.Add(s.pongTimeout); time.Now().After(lost) {
+			// Reconnecting, or trying to
+			return false, lost, map[string]bool{}
+		}
+	}
+
+	joined = make(map[string]bool, len(s.joined))
+	for ch := range s.joined {
+		joined[ch] = true
+	}
+	return connected, since, joined
+}
+
+// Pinger checks a dependency is reachable, e.g. a clickhouse driver.Conn.
+type Pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// HealthHandler serves /healthz and /readyz.
+type HealthHandler struct {
+	IRC         *IRCStatus
+	Channels    *ChannelManager
+	DB          Pinger
+	Sink        interface{ Len() int }
+	MaxBacklog  int
+	PingTimeout time.Duration
+}
+
+type readiness struct {
+	Status     string           `json:"status"`
+	IRC        ircReadiness     `json:"irc"`
+	Channels   []channelJoined  `json:"channels"`
+	ClickHouse dependencyHealth `json:"clickhouse"`
+	Sink       backlogReadiness `json:"sink"`
+	Problems   []string         `json:"problems,omitempty"`
+}
+
+type ircReadiness struct {
+	Connected bool      `json:"connected"`
+	Since     time.Time `json:"since"`
+}
+
+type channelJoined struct {
+	Login  string `json:"login"`
+	Joined bool   `json:"joined"`
+}
+
+type dependencyHealth struct {
+	OK        bool   `json:"ok"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+type backlogReadiness struct {
+	Backlog    int `json:"backlog"`
+	MaxBacklog int `json:"max_backlog"`
+}
+
+// Live reports the process is up and serving. It doesn't look at
+// dependencies, restarting won't fix those.
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// Ready reports whether we're connected to chat, can write to clickhouse and
+// aren't falling behind, responding 503 if not.
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	var res readiness
+
+	connected, since, joined := h.IRC.snapshot()
+	res.IRC = ircReadiness{Connected: connected, Since: since}
+	if !connected {
+		res.Problems = append(res.Problems, "irc not connected")
+	}
+	for _, ch := range h.Channels.List() {
+		res.Channels = append(res.Channels, channelJoined{Login: ch.Login, Joined: joined[ch.Login]})
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), h.PingTimeout)
+	defer cancel()
+	start := time.Now()
+	err := h.DB.Ping(ctx)
+	res.ClickHouse = dependencyHealth{OK: err == nil, LatencyMS: time.Since(start).Milliseconds()}
+	if err != nil {
+		res.ClickHouse.Error = err.Error()
+		res.Problems = append(res.Problems, "clickhouse unreachable")
+	}
+
+	res.Sink = backlogReadiness{Backlog: h.Sink.Len(), MaxBacklog: h.MaxBacklog}
+	if res.Sink.Backlog > h.MaxBacklog {
+		res.Problems = append(res.Problems, "sink backlog too large")
+	}
+
+	status := http.StatusOK
+	res.Status = "ok"
+	if len(res.Problems) > 0 {
+		status = http.StatusServiceUnavailable
+		res.Status = "degraded"
+	}
+	writeJSON(w, status, res)
+}
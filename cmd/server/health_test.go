@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type pingFunc func(ctx context.Context) error
+
+func (f pingFunc) Ping(ctx context.Context) error { return f(ctx) }
+
+type fixedLen int
+
+func (l fixedLen) Len() int { return int(l) }
+
+func TestReady(t *testing.T) {
+	channels := NewChannelManager(nil, nil, nil)
+	channels.channels["shindigs"] = Channel{Login: "shindigs"}
+	channels.channels["chiblee"] = Channel{Login: "chiblee"}
+
+	for _, tc := range []struct {
+		name      string
+		connected bool
+		pongLate  bool
+		pingErr   error
+		backlog   int
+		status    int
+		problems  []string
+	}{
+		{"ready", true, false, nil, 10, http.StatusOK, nil},
+		{"irc down", false, false, nil, 0, http.StatusServiceUnavailable, []string{"irc not connected"}},
+		{"irc ping unanswered", true, true, nil, 0, http.StatusServiceUnavailable, []string{"irc not connected"}},
+		{"clickhouse down", true, false, errors.New("connection refused"), 0, http.StatusServiceUnavailable, []string{"clickhouse unreachable"}},
+		{"behind", true, false, nil, 101, http.StatusServiceUnavailable, []string{"sink backlog too large"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			irc := NewIRCStatus()
+			irc.pongTimeout = 5 * time.Second
+			if tc.connected {
+				irc.Connected()
+				irc.joined["shindigs"] = true
+			}
+			if tc.pongLate {
+				irc.pingSent = time.Now().Add(-time.Minute)
+			}
+			h := &HealthHandler{
+				IRC:         irc,
+				Channels:    channels,
+				DB:          pingFunc(func(context.Context) error { return tc.pingErr }),
+				Sink:        fixedLen(tc.backlog),
+				MaxBacklog:  100,
+				PingTimeout: time.Second,
+			}
+
+			rec := httptest.NewRecorder()
+			h.Ready(rec, httptest.NewRequest("GET", "/readyz", nil))
+			if rec.Code != tc.status {
+				t.Errorf("expected status %d, got %d", tc.status, rec.Code)
+			}
+
+			var res readiness
+			if err := json.NewDecoder(rec.Body).Decode(&res); err != nil {
+				t.Fatal(err)
+			}
+			if !cmp.Equal(res.Problems, tc.problems) {
+				t.Errorf("unexpected problems\n%s", cmp.Diff(tc.problems, res.Problems))
+			}
+			wantChannels := []channelJoined{{"chiblee", false}, {"shindigs", tc.connected && !tc.pongLate}}
+			if !cmp.Equal(res.Channels, wantChannels) {
+				t.Errorf("unexpected channels\n%s", cmp.Diff(wantChannels, res.Channels))
+			}
+		})
+	}
+}
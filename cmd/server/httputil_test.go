@@ -0,0 +1,33 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCancelOn(t *testing.T) {
+	done, stop := context.WithCancel(context.Background())
+
+	started := make(chan struct{})
+	h := cancelOn(done, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+	}))
+
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/stream/1", nil))
+	}()
+
+	<-started
+	stop()
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Fatal("handler was not cancelled")
+	}
+}
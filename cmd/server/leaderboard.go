@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var leaderboardWindows = map[string]time.Duration{
+	"1h":  time.Hour,
+	"24h": 24 * time.Hour,
+	"7d":  7 * 24 * time.Hour,
+	"30d": 30 * 24 * time.Hour,
+	"all": 0,
+}
+
+const maxLeaderboardLimit = 100
+
+type LeaderboardEntry struct {
+	Rank        int    `json:"rank"`
+	ID          string `json:"id,omitempty"`
+	Login       string `json:"login,omitempty"`
+	DisplayName string `json:"display_name,omitempty"`
+	Topic       string `json:"topic,omitempty"`
+	Balance
+}
+
+// LeaderboardStore is the query the leaderboard endpoint needs.
+type LeaderboardStore interface {
+	Leaderboard(ctx context.Context, channel string, kind LeaderboardKind, since time.Time, limit int) ([]LeaderboardRow, error)
+}
+
+// LeaderboardHandler serves GET /leaderboard/{channel}.
+//
+//	kind    user, topic or giver. Defaults to user.
+//	window  1h, 24h, 7d, 30d or all. Defaults to 7d.
+//	limit   up to 100. Defaults to 10.
+type LeaderboardHandler struct {
+	Store LeaderboardStore
+	Users *UserCache
+}
+
+func (h *LeaderboardHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	channel := r.PathValue("channel")
+	q := r.URL.Query()
+
+	kind := LeaderboardKind(q.Get("kind"))
+	if kind == "" {
+		kind = LeaderboardUser
+	}
+	if kind != LeaderboardUser && kind != LeaderboardTopic && kind != LeaderboardGiver {
+		writeError(w, http.StatusBadRequest, "kind must be one of user, topic, giver")
+		return
+	}
+
+	windowParam := q.Get("window")
+	if windowParam == "" {
+		windowParam = "7d"
+	}
+	window, ok := leaderboardWindows[windowParam]
+	if !ok {
+		writeError(w, http.StatusBadRequest, "window must be one of 1h, 24h, 7d, 30d, all")
+		return
+	}
+	var since time.Time
+	if window > 0 {
+		since = time.Now().Add(-window)
+	}
+
+	limit := 10
+	if v := q.Get("limit"); v != "" {
+		l, err := strconv.Atoi(v)
+		if err != nil || l < 1 || l > maxLeaderboardLimit {
+			writeError(w, http.StatusBadRequest, "limit must be between 1 and 100")
+			return
+		}
+		limit = l
+	}
+
+	rows, err := h.Store.Leaderboard(r.Context(), channel, kind, since, limit)
+	if err != nil {
+		slog.Error("querying leaderboard", "channel", channel, "kind", kind, "err", err)
+		writeError(w, http.StatusInternalServerError, "failed to load leaderboard")
+		return
+	}
+
+	entries := make([]LeaderboardEntry, len(rows))
+	// Resolve names concurrently so the cache misses share a backfill
+	var wg sync.WaitGroup
+	for i, row := range rows {
+		e := &entries[i]
+		*e = LeaderboardEntry{Rank: i + 1, Balance: row.Balance}
+		if kind == LeaderboardTopic {
+			e.Topic = row.Key
+			continue
+		}
+		e.ID = row.Key
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, err := h.Users.GetByID(r.Context(), row.Key)
+			if err != nil {
+				slog.Warn("resolving leaderboard user", "id", row.Key, "err", err)
+				return
+			}
+			e.Login = u.Login
+			e.DisplayName = u.DisplayName
+		}()
+	}
+	wg.Wait()
+
+	writeJSON(w, http.StatusOK, entries)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type leaderboardQuery struct {
+	Channel string
+	Kind    LeaderboardKind
+	// Window is how far back since was, zero for all time.
+	Window time.Duration
+	Limit  int
+}
+
+type fakeLeaderboardStore struct {
+	queries []leaderboardQuery
+	err     error
+}
+
+func (f *fakeLeaderboardStore) Leaderboard(ctx context.Context, channel string, kind LeaderboardKind, since time.Time, limit int) ([]LeaderboardRow, error) {
+	var window time.Duration
+	if !since.IsZero() {
+		window = time.Since(since).Round(time.Hour)
+	}
+	f.queries = append(f.queries, leaderboardQuery{channel, kind, window, limit})
+	if f.err != nil {
+		return nil, f.err
+	}
+	if kind == LeaderboardTopic {
+		return []LeaderboardRow{{Key: "pizza", Balance: Balance{Total: 4, Positive: 5, Negative: -1}}}, nil
+	}
+	return []LeaderboardRow{
+		{Key: "3", Balance: Balance{Total: 5, Positive: 7, Negative: -2}},
+		{Key: "4", Balance: Balance{Total: 1, Positive: 1}},
+	}, nil
+}
+
+func TestLeaderboardHandler(t *testing.T) {
+	lookup := fakeUserLookup(&User{ID: "3", Login: "bob", DisplayName: "Bob"})
+	users := `[{"rank":1,"id":"3","login":"bob","display_name":"Bob","total":5,"positive":7,"negative":-2},` +
+		`{"rank":2,"id":"4","total":1,"positive":1,"negative":0}]`
+
+	for _, tc := range []struct {
+		query    string
+		err      error
+		status   int
+		expected *leaderboardQuery
+		body     string
+	}{
+		{"", nil, http.StatusOK, &leaderboardQuery{"1", LeaderboardUser, 7 * 24 * time.Hour, 10}, users},
+		{"?kind=giver&window=1h&limit=100", nil, http.StatusOK, &leaderboardQuery{"1", LeaderboardGiver, time.Hour, 100}, users},
+		{"?kind=topic&window=all&limit=1", nil, http.StatusOK, &leaderboardQuery{"1", LeaderboardTopic, 0, 1}, `[{"rank":1,"topic":"pizza","total":4,"positive":5,"negative":-1}]`},
+		{"?kind=streamer", nil, http.StatusBadRequest, nil, `{"error":"kind must be one of user, topic, giver","code":400}`},
+		{"?window=2h", nil, http.StatusBadRequest, nil, `{"error":"window must be one of 1h, 24h, 7d, 30d, all","code":400}`},
+		{"?limit=0", nil, http.StatusBadRequest, nil, `{"error":"limit must be between 1 and 100","code":400}`},
+		{"?limit=101", nil, http.StatusBadRequest, nil, `{"error":"limit must be between 1 and 100","code":400}`},
+		{"?limit=ten", nil, http.StatusBadRequest, nil, `{"error":"limit must be between 1 and 100","code":400}`},
+		{"", errors.New("clickhouse is down"), http.StatusInternalServerError, &leaderboardQuery{"1", LeaderboardUser, 7 * 24 * time.Hour, 10}, `{"error":"failed to load leaderboard","code":500}`},
+	} {
+		store := &fakeLeaderboardStore{err: tc.err}
+		mux := http.NewServeMux()
+		mux.Handle("GET /leaderboard/{channel}", &LeaderboardHandler{Store: store, Users: NewUserCache(10, lookup, lookup)})
+
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("GET", "/leaderboard/1"+tc.query, nil))
+		if w.Code != tc.status {
+			t.Errorf("%q: expected status %d got %d", tc.query, tc.status, w.Code)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != tc.body {
+			t.Errorf("%q: expected body %s got %s", tc.query, tc.body, got)
+		}
+		var expected []leaderboardQuery
+		if tc.expected != nil {
+			expected = []leaderboardQuery{*tc.expected}
+		}
+		if !cmp.Equal(store.queries, expected) {
+			t.Errorf("%q: did not match expected query\n%s", tc.query, cmp.Diff(store.queries, expected))
+		}
+	}
+}
@@ -3,12 +3,16 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log/slog"
 	"math/rand"
 	"net/http"
 	"os"
+	"os/signal"
 	"strings"
+	"syscall"
 	"time"
 
 	twclient "github.com/cconger/pulse/pkg/twitch"
@@ -67,10 +71,8 @@ func (c *UserResolver) lookupUserByDisplayName(ctx context.Context, displayName
 		return nil, err
 	}
 
-	slog.Info("getting user response", "users", users)
-	if users == nil || len(users) < 1 {
-		slog.Error("no users found", "displayName", displayName)
-		return nil, fmt.Errorf("no user found")
+	if len(users) < 1 {
+		return nil, fmt.Errorf("user %s: %w", displayName, twclient.ErrNotFound)
 	}
 
 	return &User{
@@ -80,10 +82,61 @@ func (c *UserResolver) lookupUserByDisplayName(ctx context.Context, displayName
 	}, nil
 }
 
+func (c *UserResolver) lookupUsersByLogin(ctx context.Context, names []string) ([]*User, error) {
+	logins := make([]string, 0, len(names))
+	for _, name := range names {
+		if login := strings.ToLower(name); validLogin.MatchString(login) {
+			logins = append(logins, login)
+		}
+	}
+	if len(logins) == 0 {
+		return nil, nil
+	}
+	slog.Info("looking up users by login", "count", len(logins))
+
+	users, err := c.TwitchClient.GetUsersByLogin(ctx, logins...)
+	return toUsers(users), ignoreNoResults(err)
+}
+
+func (c *UserResolver) lookupUsersByID(ctx context.Context, ids []string) ([]*User, error) {
+	users, err := c.TwitchClient.GetUsersByID(ctx, ids...)
+	return toUsers(users), ignoreNoResults(err)
+}
+
+func toUsers(users []*twclient.TwitchUser) []*User {
+	out := make([]*User, 0, len(users))
+	for _, u := range users {
+		out = append(out, &User{
+			ID:          u.ID,
+			DisplayName: u.DisplayName,
+			Login:       u.Login,
+		})
+	}
+	return out
+}
+
+// ignoreNoResults treats a lookup where none of the users exist as an empty
+// result, the batch reports each missing user itself.
+func ignoreNoResults(err error) error {
+	if errors.Is(err, twclient.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
 func main() {
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	fakeData := false
+	configPath := flag.String("config", os.Getenv("PULSE_CONFIG"), "path to the YAML config file")
+	flag.Parse()
+
+	cfg, err := LoadConfig(*configPath)
+	if err != nil {
+		slog.Error("loading config", "err", err)
+		os.Exit(1)
+	}
+
+	// SIGTERM is how fly stops the machine on deploy
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
 
 	reg := prometheus.NewRegistry()
 	reg.MustRegister(
@@ -91,58 +144,76 @@ func main() {
 		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
 	)
 	registerChatMetrics(reg)
+	registerSinkMetrics(reg)
+	registerPubSubMetrics(reg)
 
-	clientID := os.Getenv("TWITCH_CLIENT_ID")
-	clientSecret := os.Getenv("TWITCH_SECRET")
-
-	client, err := twclient.NewClient(clientID, clientSecret, &http.Client{})
+	client, err := twclient.NewClient(cfg.Twitch.ClientID, cfg.Twitch.ClientSecret, &http.Client{})
 	if err != nil {
 		panic(err)
 	}
-
-	clickhouseAddr := os.Getenv("CH_ADDR")
-	if clickhouseAddr == "" {
-		clickhouseAddr = "localhost:9000"
-	}
-
-	chconn, err := clickhouseClient(ctx, clickhouseAddr, clickhouse.Auth{
-		Database: "pulse",
-		Username: os.Getenv("CH_USER"),
-		Password: os.Getenv("CH_PASSWORD"),
+	client.HelixURL = strings.TrimSuffix(cfg.Twitch.HelixURL, "/")
+	client.OAuthURL = strings.TrimSuffix(cfg.Twitch.OAuthURL, "/")
+	registerTwitchMetrics(reg, client)
+
+	chconn, err := clickhouseClient(ctx, cfg.ClickHouse.Addr, clickhouse.Auth{
+		Database: cfg.ClickHouse.Database,
+		Username: cfg.ClickHouse.User,
+		Password: cfg.ClickHouse.Password,
 	})
 	if err != nil {
 		panic(err)
 	}
 
-	tSink := &ClickhouseSink{CHConn: chconn}
-	psMiddleware := NewPubSubMiddleware(tSink)
-
-	oauth := os.Getenv("TWITCH_OAUTH")
-	c := twitch.NewClient("shindaggers", "oauth:"+oauth)
-	c.Join(
-		"shindaggers",
-		"shindigs",
-		"jamsvirtual",
-		"northernlion",
-		"chiblee",
-		"HCJustin",
-		"michaelalfox",
-		"flackblag",
-		"dumbdog",
-		"baertaffy",
-		"dangheesling",
+	var tSink ClosableSink
+	if cfg.Sink.WALDir != "" {
+		tSink, err = NewDurableSink(
+			cfg.Sink.WALDir,
+			&ClickhouseSink{CHConn: chconn},
+			cfg.Sink.WALMaxBytes,
+			walOverflowPolicies[cfg.Sink.WALOverflow],
+			cfg.Sink.FlushInterval,
+		)
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		slog.Warn("sink.wal_dir not set, votes will be lost if clickhouse is unavailable")
+		tSink = NewBatchingClickhouseSink(&ClickhouseSink{CHConn: chconn}, cfg.Sink.BatchSize, cfg.Sink.FlushInterval, cfg.Sink.QueueSize)
+	}
+	psMiddleware := NewPubSubMiddleware(
+		tSink,
+		cfg.Stream.BufferSize,
+		streamOverflowPolicies[cfg.Stream.Overflow],
+		cfg.Stream.HistorySize,
 	)
 
+	c := twitch.NewClient(cfg.Twitch.BotAccount, "oauth:"+cfg.Twitch.OAuth)
+
 	userResolver := &UserResolver{
 		TwitchClient: client,
 	}
 
-	if fakeData {
+	store := &ClickhouseStore{CHConn: chconn}
+
+	channels := NewChannelManager(c, store, userResolver.lookupUserByDisplayName)
+	err = channels.Load(ctx, cfg.SeedChannels)
+	if err != nil {
+		panic(err)
+	}
+	go channels.RetryPending(ctx, time.Minute)
+
+	if cfg.FakeData {
 		go func() {
 			slog.Warn("running with random data generator!")
 			time.Sleep(5 * time.Second)
+			ticker := time.NewTicker(time.Second)
+			defer ticker.Stop()
 			for {
-				time.Sleep(1 * time.Second)
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+				}
 
 				v := rand.Intn(5) - 2
 				if v == 0 {
@@ -161,42 +232,105 @@ func main() {
 		}()
 	}
 
-	handler := ChatHandler{
-		RootContext: context.Background(),
-		UserCache: NewUserCache(
-			10000,
-			userResolver.lookupUserByDisplayName,
-		),
-		TSink: psMiddleware,
+	userCache := NewUserCache(
+		cfg.UserCacheSize,
+		userResolver.lookupUsersByLogin,
+		userResolver.lookupUsersByID,
+	)
+
+	commands := NewCommandRouter(c)
+	RegisterLedgerCommands(commands, store, userCache)
+
+	defaultChannel := cfg.Channel("")
+	defaultParser, err := NewRuleParser(*defaultChannel.Grammar)
+	if err != nil {
+		panic(err)
 	}
+	parsers := map[string]VoteParser{}
+	rateLimits := map[string]time.Duration{}
+	for name := range cfg.Channels {
+		ch := cfg.Channel(name)
+		parsers[name], err = NewRuleParser(*ch.Grammar)
+		if err != nil {
+			panic(err)
+		}
+		rateLimits[name] = *ch.RateLimit
+		commands.Channels[name] = CommandSettings{
+			Enabled:   ch.Commands,
+			Cooldowns: ch.CommandCooldowns,
+		}
+	}
+	commands.Default = CommandSettings{
+		Enabled:   defaultChannel.Commands,
+		Cooldowns: defaultChannel.CommandCooldowns,
+	}
+
+	handler := &ChatHandler{
+		RootContext:   context.Background(),
+		UserCache:     userCache,
+		TSink:         psMiddleware,
+		RateLimiter:   NewRateLimiter(*defaultChannel.RateLimit, rateLimits),
+		Policy:        NewVotePolicy(cfg.BotLogins, cfg.BotBadges),
+		Commands:      commands,
+		Parsers:       parsers,
+		DefaultParser: defaultParser,
+	}
+	ircStatus := NewIRCStatus()
+	ircStatus.Watch(c)
 	c.OnConnect(func() {
 		slog.Info("connected to twitch irc")
+		ircStatus.Connected()
 	})
 	c.OnPrivateMessage(handler.HandleMessage)
 
+	// Cancelled when the http server starts shutting down, to end the
+	// streaming handlers.
+	streamCtx, stopStreams := context.WithCancel(context.Background())
+	defer stopStreams()
+
 	mux := http.NewServeMux()
 
-	// Use id=39214310
-	mux.HandleFunc("/balance/{id}", func(w http.ResponseWriter, r *http.Request) {
-		id := r.PathValue("id")
-		slog.Info("got request", "request", r)
+	if cfg.AdminToken != "" {
+		admin := &ChannelAdminHandler{Channels: channels, Token: cfg.AdminToken}
+		admin.Register(mux)
+	} else {
+		slog.Warn("admin_token not set, admin api disabled")
+	}
 
-		res := chconn.QueryRow(r.Context(), "SELECT SUM(value) FROM pulse.checkin WHERE channel = ? and target_user = ?", id, id)
+	health := &HealthHandler{
+		IRC:         ircStatus,
+		Channels:    channels,
+		DB:          chconn,
+		Sink:        tSink,
+		MaxBacklog:  cfg.Health.MaxBacklog,
+		PingTimeout: cfg.Health.PingTimeout,
+	}
+	mux.HandleFunc("GET /healthz", health.Live)
+	mux.HandleFunc("GET /readyz", health.Ready)
 
-		if res.Err() != nil {
-			json.NewEncoder(w).Encode(res.Err())
-		}
+	balances := &BalanceHandler{Store: store, Users: userCache}
 
-		var balance int64 = 0
-		err := res.Scan(&balance)
-		if err != nil {
-			json.NewEncoder(w).Encode(err)
-		}
+	// Use id=39214310
+	mux.HandleFunc("GET /balance/{id}", balances.Streamer)
+	mux.HandleFunc("GET /balance/{channel}/user/{login}", balances.User)
+	mux.HandleFunc("GET /balance/{channel}/topic/{topic}", balances.Topic)
+
+	sse := &SSEHandler{
+		PubSub:    psMiddleware,
+		Store:     store,
+		Heartbeat: cfg.Stream.Heartbeat,
+	}
 
-		json.NewEncoder(w).Encode(balance)
-	})
+	mux.Handle("GET /candles/{channel}", &CandleHandler{Store: store, Users: userCache})
+	mux.Handle("GET /leaderboard/{channel}", &LeaderboardHandler{Store: store, Users: userCache})
+	mux.Handle("GET /ws", cancelOn(streamCtx, NewWebSocketHandler(psMiddleware, 30*time.Second, cfg.Stream.MaxSubscriptions)))
+
+	mux.Handle("GET /stream/{id}", cancelOn(streamCtx, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if acceptsEventStream(r) {
+			sse.ServeHTTP(w, r)
+			return
+		}
 
-	mux.HandleFunc("GET /stream/{id}", func(w http.ResponseWriter, r *http.Request) {
 		id := r.PathValue("id")
 		if id == "" {
 			http.NotFound(w, r)
@@ -223,20 +357,21 @@ func main() {
 			select {
 			case <-r.Context().Done():
 				return
-			case trans := <-c:
-				err := enc.Encode(trans)
+			case trans, ok := <-c:
+				if !ok {
+					return
+				}
+				err := enc.Encode(trans.Transaction)
 				if err != nil {
 					slog.Error("encoding transaction", "err", err)
 				}
 				flusher.Flush()
 			}
 		}
-	})
+	})))
 
-	port := os.Getenv("PORT")
-	port = ":" + port
 	s := &http.Server{
-		Addr:           port,
+		Addr:           ":" + cfg.Port,
 		Handler:        mux,
 		ErrorLog:       slog.NewLogLogger(slog.Default().Handler(), slog.LevelInfo),
 		ReadTimeout:    10 * time.Second,
@@ -248,9 +383,8 @@ func main() {
 
 	promMux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
 
-	promPort := ":" + os.Getenv("PROM_PORT")
 	proms := &http.Server{
-		Addr:           promPort,
+		Addr:           ":" + cfg.PromPort,
 		Handler:        promMux,
 		ErrorLog:       slog.NewLogLogger(slog.Default().Handler(), slog.LevelInfo),
 		ReadTimeout:    10 * time.Second,
@@ -258,21 +392,94 @@ func main() {
 		MaxHeaderBytes: 1 << 20,
 	}
 
+	s.RegisterOnShutdown(stopStreams)
+
+	errc := make(chan error, 2)
 	go func() {
-		if err := s.ListenAndServe(); err != nil {
-			panic(err)
+		if err := s.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errc <- fmt.Errorf("http server: %w", err)
 		}
 	}()
 
 	go func() {
-		if err := proms.ListenAndServe(); err != nil {
-			panic(err)
+		if err := proms.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+			errc <- fmt.Errorf("metrics server: %w", err)
 		}
 	}()
 
-	err = c.Connect()
-	if err != nil {
-		slog.Error("twitch irc", "err", err)
-		return
+	ircDone := make(chan error, 1)
+	go func() {
+		ircDone <- c.Connect()
+	}()
+
+	exitCode := 0
+	select {
+	case <-ctx.Done():
+		slog.Info("shutting down")
+	case err := <-errc:
+		slog.Error("shutting down", "err", err)
+		exitCode = 1
+	case err := <-ircDone:
+		slog.Error("shutting down", "err", fmt.Errorf("twitch irc: %w", err))
+		exitCode = 1
+		// Hand it back for shutdown, which waits on it
+		ircDone <- err
+	}
+	stop()
+	ircStatus.Disconnected()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := shutdown(shutdownCtx, c, ircDone, handler, s, tSink, chconn, proms); err != nil {
+		slog.Error("shutting down", "err", err)
+		exitCode = 1
+	}
+	cancel()
+	os.Exit(exitCode)
+}
+
+// shutdown stops taking votes from chat, ends the streams and http requests,
+// drains the sink into clickhouse and finally closes the connection and the
+// metrics server. ircDone yields the result of irc.Connect.
+func shutdown(ctx context.Context, irc *twitch.Client, ircDone <-chan error, chat *ChatHandler, srv *http.Server, sink ClosableSink, conn driver.Conn, proms *http.Server) error {
+	var errs []error
+
+	// Messages are handled on the goroutine running Connect, so once it
+	// returns only votes waiting on a user lookup can still reach the sink.
+	if err := irc.Disconnect(); err != nil {
+		slog.Warn("disconnecting from twitch irc", "err", err)
+	} else {
+		select {
+		case <-ircDone:
+		case <-ctx.Done():
+			errs = append(errs, fmt.Errorf("waiting for twitch irc: %w", ctx.Err()))
+		}
+	}
+	// Don't hold shutdown up for votes backing off until helix recovers
+	chat.Stop()
+	chatDone := make(chan struct{})
+	go func() {
+		chat.Wait()
+		close(chatDone)
+	}()
+	select {
+	case <-chatDone:
+	case <-ctx.Done():
+		errs = append(errs, fmt.Errorf("waiting for votes: %w", ctx.Err()))
+	}
+
+	if err := srv.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("http server: %w", err))
+	}
+	if err := sink.Close(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("draining transaction sink: %w", err))
+	}
+	if err := conn.Close(); err != nil {
+		errs = append(errs, fmt.Errorf("closing clickhouse: %w", err))
+	}
+	// Last so the drain is still visible in metrics
+	if err := proms.Shutdown(ctx); err != nil {
+		errs = append(errs, fmt.Errorf("metrics server: %w", err))
 	}
+	return errors.Join(errs...)
 }
@@ -1,6 +1,8 @@
 package main
 
 import (
+	twclient "github.com/cconger/pulse/pkg/twitch"
+
 	"github.com/prometheus/client_golang/prometheus"
 )
 
@@ -14,9 +16,121 @@ var votesProcessed = prometheus.NewCounterVec(prometheus.CounterOpts{
 	Help: "Total number of chats that yielded in a vote",
 }, []string{"channel", "type"})
 
+var votesRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_votes_rate_limited_total",
+	Help: "Total number of votes rejected by the (user, target) rate limiter",
+}, []string{"channel", "type"})
+
+var votesRejected = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_votes_rejected_total",
+	Help: "Total number of votes dropped by the vote policy, by reason",
+}, []string{"channel", "reason"})
+
+var votesRetried = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_votes_retried_total",
+	Help: "Total number of times a vote's target lookup was retried",
+}, []string{"channel"})
+
+var joinedChannels = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "chat_joined_channels",
+	Help: "Number of channels the bot is watching",
+})
+
+var chatCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "chat_commands_total",
+	Help: "Total number of chat commands handled by result",
+}, []string{"channel", "command", "result"})
+
 func registerChatMetrics(reg *prometheus.Registry) {
 	reg.MustRegister(
 		chatMessages,
 		votesProcessed,
+		votesRateLimited,
+		votesRejected,
+		votesRetried,
+		chatCommands,
+		joinedChannels,
 	)
 }
+
+var batchQueueDepth = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sink_batch_queue_depth",
+	Help: "Number of transactions waiting to be flushed to clickhouse",
+})
+
+var batchFlushLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "sink_batch_flush_seconds",
+	Help:    "Time taken to flush a batch of transactions to clickhouse",
+	Buckets: prometheus.DefBuckets,
+})
+
+var batchSize = prometheus.NewHistogram(prometheus.HistogramOpts{
+	Name:    "sink_batch_size",
+	Help:    "Number of transactions in each flushed batch",
+	Buckets: prometheus.ExponentialBuckets(1, 2, 12),
+})
+
+var batchFlushErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sink_batch_flush_errors_total",
+	Help: "Total number of batches that failed to flush",
+})
+
+var walBytes = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sink_wal_bytes",
+	Help: "Bytes of transactions held in the write-ahead log",
+})
+
+var walPending = prometheus.NewGauge(prometheus.GaugeOpts{
+	Name: "sink_wal_pending",
+	Help: "Number of transactions in the write-ahead log waiting to be replayed",
+})
+
+var walReplayErrors = prometheus.NewCounter(prometheus.CounterOpts{
+	Name: "sink_wal_replay_errors_total",
+	Help: "Total number of failed attempts to replay the write-ahead log",
+})
+
+var walDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "sink_wal_dropped_total",
+	Help: "Total number of transactions the write-ahead log dropped or refused",
+}, []string{"reason"})
+
+func registerSinkMetrics(reg *prometheus.Registry) {
+	reg.MustRegister(
+		batchQueueDepth,
+		batchFlushLatency,
+		batchSize,
+		batchFlushErrors,
+		walBytes,
+		walPending,
+		walReplayErrors,
+		walDropped,
+	)
+}
+
+var pubsubSubscribers = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+	Name: "pubsub_subscribers",
+	Help: "Number of live stream subscribers",
+}, []string{"channel"})
+
+var pubsubDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+	Name: "pubsub_dropped_total",
+	Help: "Total number of events that overflowed a subscriber buffer",
+}, []string{"channel", "policy"})
+
+func registerPubSubMetrics(reg *prometheus.Registry) {
+	reg.MustRegister(
+		pubsubSubscribers,
+		pubsubDropped,
+	)
+}
+
+// registerTwitchMetrics exports the helix client's view of its rate limit.
+func registerTwitchMetrics(reg *prometheus.Registry, client *twclient.Client) {
+	reg.MustRegister(prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "twitch_helix_ratelimit_remaining",
+		Help: "Requests left in the current helix rate limit window, -1 before the first request",
+	}, func() float64 {
+		return float64(client.RateLimitRemaining())
+	}))
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"strings"
+
+	twitchirc "github.com/gempir/go-twitch-irc/v4"
+)
+
+// Reasons a VotePolicy rejects a vote, used as metric labels.
+const (
+	rejectSelfVote  = "self_vote"
+	rejectBotSource = "bot_source"
+	rejectBotTarget = "bot_target"
+)
+
+// DefaultBotLogins are common channel bots that should never vote or be voted on.
+var DefaultBotLogins = []string{
+	"nightbot",
+	"streamelements",
+	"streamlabs",
+	"moobot",
+	"fossabot",
+	"wizebot",
+	"sery_bot",
+	"soundalerts",
+}
+
+// DefaultBotBadges are chat badges that mark an account as a bot.
+var DefaultBotBadges = []string{
+	"bot-badge",
+}
+
+// VotePolicy filters out votes that shouldn't count regardless of rate limits.
+type VotePolicy struct {
+	BotLogins map[string]bool
+	BotBadges []string
+}
+
+func NewVotePolicy(botLogins []string, botBadges []string) *VotePolicy {
+	p := &VotePolicy{
+		BotLogins: make(map[string]bool, len(botLogins)),
+		BotBadges: botBadges,
+	}
+	for _, l := range botLogins {
+		p.BotLogins[strings.ToLower(l)] = true
+	}
+	return p
+}
+
+// Check returns the reason the vote should be dropped, or "" if it's allowed.
+// targetLogin is the login of the targeted user, empty for topics.
+func (p *VotePolicy) Check(m twitchirc.PrivateMessage, t Transaction, targetLogin string) string {
+	if p.isBot(m.User.Name) {
+		return rejectBotSource
+	}
+	for _, badge := range p.BotBadges {
+		if _, ok := m.User.Badges[badge]; ok {
+			return rejectBotSource
+		}
+	}
+	if t.TargetUser != "" && t.TargetUser == t.Source {
+		return rejectSelfVote
+	}
+	if targetLogin != "" && p.isBot(targetLogin) {
+		return rejectBotTarget
+	}
+	return ""
+}
+
+func (p *VotePolicy) isBot(login string) bool {
+	return p.BotLogins[strings.ToLower(login)]
+}
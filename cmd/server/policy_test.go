@@ -0,0 +1,35 @@
+package main
+
+import (
+	"testing"
+
+	twitchirc "github.com/gempir/go-twitch-irc/v4"
+)
+
+func TestVotePolicy(t *testing.T) {
+	p := NewVotePolicy([]string{"Nightbot"}, DefaultBotBadges)
+
+	voter := twitchirc.User{ID: "9", Name: "voter"}
+	bot := twitchirc.User{ID: "8", Name: "nightbot"}
+	badged := twitchirc.User{ID: "7", Name: "custombot", Badges: map[string]int{"bot-badge": 1}}
+
+	for _, tc := range []struct {
+		name        string
+		user        twitchirc.User
+		t           Transaction
+		targetLogin string
+		expected    string
+	}{
+		{"normal vote", voter, Transaction{Source: "9", TargetUser: "1"}, "streamer", ""},
+		{"topic vote", voter, Transaction{Source: "9", TargetTopic: "topic"}, "", ""},
+		{"self vote", voter, Transaction{Source: "9", TargetUser: "9"}, "voter", rejectSelfVote},
+		{"bot voter", bot, Transaction{Source: "8", TargetUser: "1"}, "streamer", rejectBotSource},
+		{"badged bot voter", badged, Transaction{Source: "7", TargetUser: "1"}, "streamer", rejectBotSource},
+		{"vote for bot", voter, Transaction{Source: "9", TargetUser: "8"}, "NightBot", rejectBotTarget},
+	} {
+		got := p.Check(twitchirc.PrivateMessage{User: tc.user}, tc.t, tc.targetLogin)
+		if got != tc.expected {
+			t.Errorf("%s: expected %q got %q", tc.name, tc.expected, got)
+		}
+	}
+}
@@ -4,45 +4,121 @@ import (
 	"context"
 	"fmt"
 	"sync"
+	"time"
 )
 
+// OverflowPolicy decides what happens when a subscriber's buffer is full.
+type OverflowPolicy int
+
+const (
+	// DropOldest discards the oldest buffered event to make room.
+	DropOldest OverflowPolicy = iota
+	// DropNewest discards the event being published.
+	DropNewest
+	// Disconnect unsubscribes the subscriber and closes its channel.
+	Disconnect
+)
+
+func (o OverflowPolicy) String() string {
+	switch o {
+	case DropOldest:
+		return "drop_oldest"
+	case DropNewest:
+		return "drop_newest"
+	case Disconnect:
+		return "disconnect"
+	}
+	return "unknown"
+}
+
+// Event is a transaction as delivered to subscribers. IDs are increasing within
+// a channel and are seeded from the clock so they keep increasing across
+// restarts.
+type Event struct {
+	ID uint64
+	Transaction
+}
+
 type PubSubMiddleware struct {
-	Sink TransactionSink
+	Sink        TransactionSink
+	BufferSize  int
+	Overflow    OverflowPolicy
+	HistorySize int
 
-	subscriberMutex sync.RWMutex
-	subscribers     map[string][]chan Transaction
+	subscriberMutex sync.Mutex
+	subscribers     map[string][]chan Event
+	history         map[string][]Event
+	lastID          map[string]uint64
 }
 
-func NewPubSubMiddleware(sink TransactionSink) *PubSubMiddleware {
-	// TODO: Instrument this so we can see how many subs we have
+func NewPubSubMiddleware(sink TransactionSink, bufferSize int, overflow OverflowPolicy, historySize int) *PubSubMiddleware {
 	return &PubSubMiddleware{
 		Sink:        sink,
-		subscribers: make(map[string][]chan Transaction),
+		BufferSize:  bufferSize,
+		Overflow:    overflow,
+		HistorySize: historySize,
+		subscribers: make(map[string][]chan Event),
+		history:     make(map[string][]Event),
+		lastID:      make(map[string]uint64),
 	}
 }
 
-func (p *PubSubMiddleware) Subscribe(ctx context.Context, channel string) (chan Transaction, func() error) {
-	ch := make(chan Transaction)
+// Subscribe registers for transactions in channel. The returned channel is
+// closed when unsubscribed, including when the subscriber is disconnected for
+// falling behind.
+func (p *PubSubMiddleware) Subscribe(ctx context.Context, channel string) (chan Event, func() error) {
+	_, ch, unsub := p.SubscribeSince(ctx, channel, 0)
+	return ch, unsub
+}
+
+// SubscribeSince is Subscribe but also returns the buffered events with an ID
+// greater than lastID, so a reconnecting client can resume without gaps.
+// A lastID of 0 returns no history.
+func (p *PubSubMiddleware) SubscribeSince(ctx context.Context, channel string, lastID uint64) ([]Event, chan Event, func() error) {
+	ch := make(chan Event, p.BufferSize)
 
 	p.subscriberMutex.Lock()
 	defer p.subscriberMutex.Unlock()
 	p.subscribers[channel] = append(p.subscribers[channel], ch)
+	pubsubSubscribers.WithLabelValues(channel).Inc()
+
+	var missed []Event
+	if lastID > 0 {
+		for _, e := range p.history[channel] {
+			if e.ID > lastID {
+				missed = append(missed, e)
+			}
+		}
+	}
 
-	return ch, func() error {
+	return missed, ch, func() error {
 		p.subscriberMutex.Lock()
 		defer p.subscriberMutex.Unlock()
 
-		for i, sub := range p.subscribers[channel] {
-			if sub == ch {
-				// Swap this chanel to the end and then truncate
-				p.subscribers[channel][i] = p.subscribers[channel][len(p.subscribers[channel])-1]
-				p.subscribers[channel] = p.subscribers[channel][:len(p.subscribers[channel])-1]
-				close(ch)
-				return nil
+		if !p.removeLocked(channel, ch) {
+			return fmt.Errorf("channel not found")
+		}
+		return nil
+	}
+}
+
+// removeLocked must be called with subscriberMutex held.
+func (p *PubSubMiddleware) removeLocked(channel string, ch chan Event) bool {
+	subs := p.subscribers[channel]
+	for i, sub := range subs {
+		if sub == ch {
+			// Swap this chanel to the end and then truncate
+			subs[i] = subs[len(subs)-1]
+			p.subscribers[channel] = subs[:len(subs)-1]
+			if len(p.subscribers[channel]) == 0 {
+				delete(p.subscribers, channel)
 			}
+			close(ch)
+			pubsubSubscribers.WithLabelValues(channel).Dec()
+			return true
 		}
-		return fmt.Errorf("channel not found")
 	}
+	return false
 }
 
 func (p *PubSubMiddleware) Insert(ctx context.Context, t Transaction) error {
@@ -52,13 +128,64 @@ func (p *PubSubMiddleware) Insert(ctx context.Context, t Transaction) error {
 		return err
 	}
 
-	// Then notify anyone who is subbed
-	p.subscriberMutex.RLock()
-	defer p.subscriberMutex.RUnlock()
-	channels := p.subscribers[t.Channel]
-	for _, c := range channels {
-		c <- t
+	// Then notify anyone who is subbed. Publishing never blocks so it's fine
+	// to hold the write lock while we do it.
+	p.subscriberMutex.Lock()
+	defer p.subscriberMutex.Unlock()
+
+	e := Event{ID: p.nextIDLocked(t.Channel), Transaction: t}
+	if p.HistorySize > 0 {
+		h := append(p.history[t.Channel], e)
+		if len(h) > p.HistorySize {
+			h = h[len(h)-p.HistorySize:]
+		}
+		p.history[t.Channel] = h
+	}
+
+	var evict []chan Event
+	for _, c := range p.subscribers[t.Channel] {
+		if !p.publish(c, e) {
+			evict = append(evict, c)
+		}
+	}
+	for _, c := range evict {
+		p.removeLocked(t.Channel, c)
 	}
 
 	return nil
 }
+
+func (p *PubSubMiddleware) nextIDLocked(channel string) uint64 {
+	id := p.lastID[channel] + 1
+	if seed := uint64(time.Now().UnixMicro()); seed > id {
+		id = seed
+	}
+	p.lastID[channel] = id
+	return id
+}
+
+// publish delivers e to c according to the overflow policy. It returns false
+// if the subscriber should be disconnected.
+func (p *PubSubMiddleware) publish(c chan Event, e Event) bool {
+	select {
+	case c <- e:
+		return true
+	default:
+	}
+
+	pubsubDropped.WithLabelValues(e.Channel, p.Overflow.String()).Inc()
+	switch p.Overflow {
+	case DropOldest:
+		select {
+		case <-c:
+		default:
+		}
+		select {
+		case c <- e:
+		default:
+		}
+	case Disconnect:
+		return false
+	}
+	return true
+}
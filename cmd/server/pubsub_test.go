@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestPubSubOverflow(t *testing.T) {
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		policy   OverflowPolicy
+		expected []int
+		closed   bool
+	}{
+		{DropOldest, []int{2, 3}, false},
+		{DropNewest, []int{1, 2}, false},
+		{Disconnect, []int{1, 2}, true},
+	} {
+		p := NewPubSubMiddleware(&PrintSink{}, 2, tc.policy, 0)
+		c, unsub := p.Subscribe(ctx, "1")
+
+		for i := 1; i <= 3; i++ {
+			if err := p.Insert(ctx, Transaction{Channel: "1", Value: i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var got []int
+		for i := 0; i < 2; i++ {
+			got = append(got, (<-c).Value)
+		}
+		for i := range tc.expected {
+			if got[i] != tc.expected[i] {
+				t.Errorf("%s: expected %v got %v", tc.policy, tc.expected, got)
+				break
+			}
+		}
+
+		if tc.closed {
+			if _, open := <-c; open {
+				t.Errorf("%s: expected subscriber to be disconnected", tc.policy)
+			}
+			if unsub() == nil {
+				t.Errorf("%s: expected unsubscribe after disconnect to fail", tc.policy)
+			}
+			continue
+		}
+		if err := unsub(); err != nil {
+			t.Errorf("%s: unsubscribe: %v", tc.policy, err)
+		}
+	}
+}
+
+func TestPubSubResume(t *testing.T) {
+	ctx := context.Background()
+	p := NewPubSubMiddleware(&PrintSink{}, 8, DropOldest, 2)
+
+	var ids []uint64
+	c, unsub := p.Subscribe(ctx, "1")
+	for i := 1; i <= 3; i++ {
+		if err := p.Insert(ctx, Transaction{Channel: "1", Value: i}); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, (<-c).ID)
+	}
+	unsub()
+
+	if ids[0] >= ids[1] || ids[1] >= ids[2] {
+		t.Fatalf("expected increasing ids, got %v", ids)
+	}
+
+	missed, _, unsub := p.SubscribeSince(ctx, "1", ids[1])
+	defer unsub()
+	if len(missed) != 1 || missed[0].Value != 3 {
+		t.Errorf("expected to resume with the last vote, got %+v", missed)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Balance is the sum of votes along with the positive and negative components.
+type Balance struct {
+	Total    int64 `json:"total"`
+	Positive int64 `json:"positive"`
+	Negative int64 `json:"negative"`
+}
+
+// ClickhouseStore runs read queries against the pulse.checkin table.
+type ClickhouseStore struct {
+	CHConn driver.Conn
+}
+
+// UserBalance is the balance of votes targeted at a user in a channel.
+func (s *ClickhouseStore) UserBalance(ctx context.Context, channel string, userID string) (*Balance, error) {
+	return s.balance(ctx, `
+    SELECT sum(value), sumIf(value, value > 0), sumIf(value, value < 0)
+    FROM pulse.checkin
+    WHERE channel = ? AND target_user = ? AND target_topic = ''
+  `, channel, userID)
+}
+
+// TopicBalance is the balance of votes targeted at a topic in a channel.
+func (s *ClickhouseStore) TopicBalance(ctx context.Context, channel string, topic string) (*Balance, error) {
+	return s.balance(ctx, `
+    SELECT sum(value), sumIf(value, value > 0), sumIf(value, value < 0)
+    FROM pulse.checkin
+    WHERE channel = ? AND lowerUTF8(normalizeUTF8NFC(target_topic)) = ?
+  `, channel, normalizeName(topic))
+}
+
+// Ledger is the balance of votes a user has given out in a channel.
+func (s *ClickhouseStore) Ledger(ctx context.Context, channel string, sourceID string) (*Balance, error) {
+	return s.balance(ctx, `
+    SELECT sum(value), sumIf(value, value > 0), sumIf(value, value < 0)
+    FROM pulse.checkin
+    WHERE channel = ? AND source = ?
+  `, channel, sourceID)
+}
+
+func (s *ClickhouseStore) balance(ctx context.Context, query string, args ...any) (*Balance, error) {
+	var b Balance
+	err := s.CHConn.QueryRow(ctx, query, args...).Scan(&b.Total, &b.Positive, &b.Negative)
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// Candle is the open/high/low/close of a target's cumulative balance over a
+// time bucket.
+type Candle struct {
+	Time  time.Time `json:"time"`
+	Open  int64     `json:"open"`
+	High  int64     `json:"high"`
+	Low   int64     `json:"low"`
+	Close int64     `json:"close"`
+}
+
+// Candles buckets the cumulative balance of a target by interval between from
+// and to. It reads the per-minute rollup in pulse.checkin_minute so high/low
+// have minute resolution. Buckets with no votes are omitted.
+func (s *ClickhouseStore) Candles(ctx context.Context, channel string, targetUser string, targetTopic string, interval time.Duration, from time.Time, to time.Time) ([]Candle, error) {
+	rows, err := s.CHConn.Query(ctx, `
+    WITH running AS (
+      SELECT
+        minute,
+        delta,
+        sum(delta) OVER (ORDER BY minute ROWS BETWEEN UNBOUNDED PRECEDING AND CURRENT ROW) AS balance
+      FROM (
+        SELECT minute, sum(delta) AS delta
+        FROM pulse.checkin_minute
+        WHERE channel = ? AND target_user = ? AND target_topic = ? AND minute < ?
+        GROUP BY minute
+      )
+    )
+    SELECT minute, delta, balance
+    FROM running
+    WHERE minute >= ?
+    ORDER BY minute
+  `, channel, targetUser, normalizeName(targetTopic), to, from)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var minutes []minuteBalance
+	for rows.Next() {
+		var m minuteBalance
+		if err := rows.Scan(&m.Minute, &m.Delta, &m.Balance); err != nil {
+			return nil, err
+		}
+		minutes = append(minutes, m)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return bucketCandles(minutes, interval), nil
+}
+
+// minuteBalance is the net vote in a minute and the running balance at its end.
+type minuteBalance struct {
+	Minute  time.Time
+	Delta   int64
+	Balance int64
+}
+
+// bucketCandles folds consecutive minutes into candles of interval. Buckets
+// line up with the unix epoch, like toStartOfInterval.
+func bucketCandles(minutes []minuteBalance, interval time.Duration) []Candle {
+	var candles []Candle
+	for _, m := range minutes {
+		bucket := m.Minute.Truncate(interval).UTC()
+		if n := len(candles); n == 0 || !candles[n-1].Time.Equal(bucket) {
+			open := m.Balance - m.Delta
+			candles = append(candles, Candle{Time: bucket, Open: open, High: open, Low: open})
+		}
+		c := &candles[len(candles)-1]
+		c.High = max(c.High, m.Balance)
+		c.Low = min(c.Low, m.Balance)
+		c.Close = m.Balance
+	}
+	return candles
+}
+
+// LeaderboardKind selects what a leaderboard ranks.
+type LeaderboardKind string
+
+const (
+	// LeaderboardUser ranks users by the votes they've received.
+	LeaderboardUser LeaderboardKind = "user"
+	// LeaderboardTopic ranks topics by the votes they've received.
+	LeaderboardTopic LeaderboardKind = "topic"
+	// LeaderboardGiver ranks users by the positive votes they've handed out.
+	LeaderboardGiver LeaderboardKind = "giver"
+)
+
+// LeaderboardRow is the raw id, either a user id or topic, and its balance.
+type LeaderboardRow struct {
+	Key string
+	Balance
+}
+
+// Leaderboard ranks the top limit keys of the given kind in a channel since
+// the given time, or over all time if since is zero.
+func (s *ClickhouseStore) Leaderboard(ctx context.Context, channel string, kind LeaderboardKind, since time.Time, limit int) ([]LeaderboardRow, error) {
+	var key, filter, order string
+	switch kind {
+	case LeaderboardUser:
+		key, filter, order = "target_user", "target_user != '' AND target_topic = ''", "total"
+	case LeaderboardTopic:
+		key, filter, order = "lowerUTF8(normalizeUTF8NFC(target_topic))", "target_topic != ''", "total"
+	case LeaderboardGiver:
+		key, filter, order = "source", "1", "positive"
+	default:
+		return nil, fmt.Errorf("unknown leaderboard kind %q", kind)
+	}
+
+	args := []any{channel}
+	if !since.IsZero() {
+		// The zero time is outside the range of a clickhouse DateTime
+		filter += " AND timestamp >= ?"
+		args = append(args, since)
+	}
+	args = append(args, limit)
+
+	rows, err := s.CHConn.Query(ctx, fmt.Sprintf(`
+    SELECT %s AS key, sum(value) AS total, sumIf(value, value > 0) AS positive, sumIf(value, value < 0) AS negative
+    FROM pulse.checkin
+    WHERE channel = ? AND %s
+    GROUP BY key
+    ORDER BY %s DESC, key
+    LIMIT ?
+  `, key, filter, order), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var board []LeaderboardRow
+	for rows.Next() {
+		var r LeaderboardRow
+		if err := rows.Scan(&r.Key, &r.Total, &r.Positive, &r.Negative); err != nil {
+			return nil, err
+		}
+		board = append(board, r)
+	}
+	return board, rows.Err()
+}
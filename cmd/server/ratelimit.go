@@ -0,0 +1,92 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+type rateLimitKey struct {
+	Channel string
+	Source  string
+	Target  string
+}
+
+// RateLimiter only lets a given (channel, source, target) tuple vote once per
+// window. Windows can be overridden per channel name.
+type RateLimiter struct {
+	DefaultWindow  time.Duration
+	ChannelWindows map[string]time.Duration
+
+	mu        sync.Mutex
+	lastVote  map[rateLimitKey]time.Time
+	lastSweep time.Time
+}
+
+func NewRateLimiter(defaultWindow time.Duration, channelWindows map[string]time.Duration) *RateLimiter {
+	if channelWindows == nil {
+		channelWindows = make(map[string]time.Duration)
+	}
+	return &RateLimiter{
+		DefaultWindow:  defaultWindow,
+		ChannelWindows: channelWindows,
+		lastVote:       make(map[rateLimitKey]time.Time),
+	}
+}
+
+func (r *RateLimiter) window(channel string) time.Duration {
+	if w, ok := r.ChannelWindows[channel]; ok {
+		return w
+	}
+	return r.DefaultWindow
+}
+
+// Allow reports whether the transaction should be accepted, recording it if so.
+// channel is the channel name used to look up the configured window.
+func (r *RateLimiter) Allow(channel string, t Transaction) bool {
+	window := r.window(channel)
+	if window <= 0 {
+		return true
+	}
+
+	key := rateLimitKey{
+		Channel: t.Channel,
+		Source:  t.Source,
+		Target:  "user:" + t.TargetUser,
+	}
+	if t.TargetTopic != "" {
+		key.Target = "topic:" + t.TargetTopic
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.sweep(t.Timestamp)
+
+	if last, ok := r.lastVote[key]; ok && t.Timestamp.Sub(last) < window {
+		return false
+	}
+	r.lastVote[key] = t.Timestamp
+	return true
+}
+
+// sweep drops entries that are older than any configured window so the map
+// doesn't grow forever. Must be called with mu held.
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.lastSweep) < time.Minute {
+		return
+	}
+	r.lastSweep = now
+
+	maxWindow := r.DefaultWindow
+	for _, w := range r.ChannelWindows {
+		if w > maxWindow {
+			maxWindow = w
+		}
+	}
+
+	for k, last := range r.lastVote {
+		if now.Sub(last) >= maxWindow {
+			delete(r.lastVote, k)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)
+	rl := NewRateLimiter(30*time.Second, map[string]time.Duration{
+		"fast": 0,
+	})
+
+	vote := func(channel, source, user, topic string, at time.Duration) Transaction {
+		return Transaction{
+			Channel:     channel,
+			Source:      source,
+			TargetUser:  user,
+			TargetTopic: topic,
+			Value:       2,
+			Timestamp:   now.Add(at),
+		}
+	}
+
+	for _, tc := range []struct {
+		name     string
+		channel  string
+		t        Transaction
+		expected bool
+	}{
+		{"first vote", "slow", vote("1", "a", "2", "", 0), true},
+		{"repeat vote", "slow", vote("1", "a", "2", "", 10*time.Second), false},
+		{"different target", "slow", vote("1", "a", "3", "", 10*time.Second), true},
+		{"topic target", "slow", vote("1", "a", "", "2", 10*time.Second), true},
+		{"different source", "slow", vote("1", "b", "2", "", 10*time.Second), true},
+		{"after window", "slow", vote("1", "a", "2", "", 31*time.Second), true},
+		{"unlimited channel", "fast", vote("9", "a", "2", "", 0), true},
+		{"unlimited channel repeat", "fast", vote("9", "a", "2", "", 0), true},
+	} {
+		if got := rl.Allow(tc.channel, tc.t); got != tc.expected {
+			t.Errorf("%s: expected %v got %v", tc.name, tc.expected, got)
+		}
+	}
+}
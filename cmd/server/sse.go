@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SSEHandler streams a channel's votes as Server-Sent Events. It emits:
+//
+//	vote      every transaction, with the pubsub event id
+//	balance   the streamer's approximate balance whenever they are voted on
+//	heartbeat periodically so proxies don't time the connection out
+//
+// Reconnecting clients send Last-Event-ID and get any votes they missed that
+// are still in the pubsub history.
+//
+// The balance is only approximate. It starts from the stored balance and adds
+// live votes, but the sink writes asynchronously, so votes still waiting to
+// be flushed, replayed ones included, are missing from it and live votes
+// flushed between subscribing and loading it are counted twice.
+type SSEHandler struct {
+	PubSub    *PubSubMiddleware
+	Store     LedgerStore
+	Heartbeat time.Duration
+}
+
+type sseBalance struct {
+	Channel string `json:"channel"`
+	Target  string `json:"target"`
+	Balance
+}
+
+type sseHeartbeat struct {
+	Time time.Time `json:"time"`
+}
+
+// acceptsEventStream reports whether the client asked for text/event-stream.
+func acceptsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+func (h *SSEHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	if id == "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	var lastID uint64
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		lastEventID = r.URL.Query().Get("lastEventId")
+	}
+	if lastEventID != "" {
+		var err error
+		lastID, err = strconv.ParseUint(lastEventID, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid Last-Event-ID", http.StatusBadRequest)
+			return
+		}
+	}
+
+	rc := http.NewResponseController(w)
+	missed, c, unsub := h.PubSub.SubscribeSince(r.Context(), id, lastID)
+	defer unsub()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(event string, eventID uint64, v any) bool {
+		// The server has a write timeout, keep pushing it out while we stream.
+		rc.SetWriteDeadline(time.Now().Add(h.Heartbeat + 10*time.Second))
+		if err := writeSSE(w, event, eventID, v); err != nil {
+			slog.Debug("writing sse event", "err", err)
+			return false
+		}
+		return rc.Flush() == nil
+	}
+
+	fmt.Fprintf(w, "retry: %d\n\n", 3000)
+	for _, e := range missed {
+		if !write("vote", e.ID, e.Transaction) {
+			return
+		}
+	}
+
+	balance, err := h.Store.UserBalance(r.Context(), id, id)
+	if err != nil {
+		slog.Error("loading balance for stream", "channel", id, "err", err)
+		balance = &Balance{}
+	}
+	if !write("balance", 0, sseBalance{Channel: id, Target: id, Balance: *balance}) {
+		return
+	}
+
+	sendVote := func(e Event) bool {
+		if !write("vote", e.ID, e.Transaction) {
+			return false
+		}
+		if e.TargetUser != id || e.TargetTopic != "" {
+			return true
+		}
+		balance.Total += int64(e.Value)
+		if e.Value > 0 {
+			balance.Positive += int64(e.Value)
+		} else {
+			balance.Negative += int64(e.Value)
+		}
+		return write("balance", 0, sseBalance{Channel: id, Target: id, Balance: *balance})
+	}
+
+	ticker := time.NewTicker(h.Heartbeat)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case t := <-ticker.C:
+			if !write("heartbeat", 0, sseHeartbeat{Time: t.UTC()}) {
+				return
+			}
+		case e, ok := <-c:
+			if !ok {
+				return
+			}
+			if !sendVote(e) {
+				return
+			}
+		}
+	}
+}
+
+// writeSSE writes a single event. An eventID of 0 is omitted so it doesn't
+// reset the client's Last-Event-ID.
+func writeSSE(w io.Writer, event string, eventID uint64, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if eventID != 0 {
+		if _, err := fmt.Fprintf(w, "id: %d\n", eventID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, data)
+	return err
+}
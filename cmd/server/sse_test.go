@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type sseEvent struct {
+	ID    string
+	Event string
+	Data  string
+}
+
+// readSSE reads events from body until it's closed.
+func readSSE(body *bufio.Scanner) <-chan sseEvent {
+	events := make(chan sseEvent, 16)
+	go func() {
+		defer close(events)
+		var e sseEvent
+		for body.Scan() {
+			line := body.Text()
+			switch {
+			case line == "":
+				if e.Event != "" {
+					events <- e
+				}
+				e = sseEvent{}
+			case strings.HasPrefix(line, "id: "):
+				e.ID = strings.TrimPrefix(line, "id: ")
+			case strings.HasPrefix(line, "event: "):
+				e.Event = strings.TrimPrefix(line, "event: ")
+			case strings.HasPrefix(line, "data: "):
+				e.Data = strings.TrimPrefix(line, "data: ")
+			}
+		}
+	}()
+	return events
+}
+
+func TestSSEResume(t *testing.T) {
+	ctx := context.Background()
+	ps := NewPubSubMiddleware(&PrintSink{}, 10, DropOldest, 10)
+
+	// Both votes being replayed have been flushed to the store
+	store := &fakeLedger{users: map[string]*Balance{"1": {Total: 3, Positive: 3}}}
+	mux := http.NewServeMux()
+	mux.Handle("GET /stream/{id}", &SSEHandler{PubSub: ps, Store: store, Heartbeat: time.Hour})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	seen, unsub := ps.Subscribe(ctx, "1")
+	for _, v := range []int{1, 2} {
+		if err := ps.Insert(ctx, Transaction{Channel: "1", Source: "2", TargetUser: "1", Value: v}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	first := <-seen
+	unsub()
+
+	req, err := http.NewRequest("GET", srv.URL+"/stream/1", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Last-Event-ID", strconv.FormatUint(first.ID, 10))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	events := readSSE(bufio.NewScanner(resp.Body))
+
+	next := func() sseEvent {
+		t.Helper()
+		select {
+		case e := <-events:
+			return e
+		case <-time.After(5 * time.Second):
+			t.Fatal("timed out waiting for an event")
+		}
+		return sseEvent{}
+	}
+	balanceOf := func(e sseEvent) int64 {
+		t.Helper()
+		if e.Event != "balance" {
+			t.Fatalf("expected a balance event, got %+v", e)
+		}
+		var b sseBalance
+		if err := json.Unmarshal([]byte(e.Data), &b); err != nil {
+			t.Fatal(err)
+		}
+		return b.Total
+	}
+
+	if e := next(); e.Event != "vote" || !strings.Contains(e.Data, `"Value":2`) {
+		t.Fatalf("expected the missed vote to be replayed, got %+v", e)
+	}
+	if total := balanceOf(next()); total != 3 {
+		t.Errorf("expected the stored balance after replay, got %d", total)
+	}
+
+	if err := ps.Insert(ctx, Transaction{Channel: "1", Source: "2", TargetUser: "1", Value: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if e := next(); e.Event != "vote" {
+		t.Fatalf("expected the live vote, got %+v", e)
+	}
+	if total := balanceOf(next()); total != 2 {
+		t.Errorf("expected live votes to move the balance, got %d", total)
+	}
+}
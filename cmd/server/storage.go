@@ -15,12 +15,28 @@ type Transaction struct {
 	TargetTopic string
 	Value       int
 	Timestamp   time.Time
+	// FromReply is set when TargetUser was inferred from the message being a
+	// reply rather than an explicit @mention.
+	FromReply bool
 }
 
 type TransactionSink interface {
 	Insert(ctx context.Context, t Transaction) error
 }
 
+// ClosableSink is a TransactionSink that buffers and must be drained before exit.
+type ClosableSink interface {
+	TransactionSink
+	// Len is the number of transactions not yet written downstream.
+	Len() int
+	Close(ctx context.Context) error
+}
+
+// BatchSink is a sink that synchronously writes many transactions at once.
+type BatchSink interface {
+	InsertBatch(ctx context.Context, ts []Transaction) error
+}
+
 type ClickhouseSink struct {
 	CHConn driver.Conn
 }
@@ -28,18 +44,48 @@ type ClickhouseSink struct {
 func (c *ClickhouseSink) Insert(ctx context.Context, t Transaction) error {
 	slog.Info("inserting transaction", "transaction", t)
 	err := c.CHConn.Exec(ctx, `
-    INSERT INTO pulse.checkin (channel, source, target_user, target_topic, value, timestamp)
-    VALUES (?, ?, ?, ?, ?, ?)
-  `, t.Channel, t.Source, t.TargetUser, t.TargetTopic, t.Value, t.Timestamp)
+    INSERT INTO pulse.checkin (channel, source, target_user, target_topic, value, timestamp, from_reply)
+    VALUES (?, ?, ?, ?, ?, ?, ?)
+  `, t.Channel, t.Source, t.TargetUser, t.TargetTopic, t.Value, t.Timestamp, t.FromReply)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+func (c *ClickhouseSink) InsertBatch(ctx context.Context, ts []Transaction) error {
+	return insertBatch(ctx, c.CHConn, ts)
+}
+
+func insertBatch(ctx context.Context, conn driver.Conn, ts []Transaction) error {
+	batch, err := conn.PrepareBatch(ctx, `
+    INSERT INTO pulse.checkin (channel, source, target_user, target_topic, value, timestamp, from_reply)
+  `)
+	if err != nil {
+		return err
+	}
+
+	for _, t := range ts {
+		err := batch.Append(t.Channel, t.Source, t.TargetUser, t.TargetTopic, int8(t.Value), t.Timestamp, t.FromReply)
+		if err != nil {
+			batch.Abort()
+			return err
+		}
+	}
+
+	return batch.Send()
+}
+
 type PrintSink struct{}
 
 func (p *PrintSink) Insert(ctx context.Context, t Transaction) error {
 	slog.Info("transaction", "transaction", t)
 	return nil
 }
+
+func (p *PrintSink) InsertBatch(ctx context.Context, ts []Transaction) error {
+	for _, t := range ts {
+		slog.Info("transaction", "transaction", t)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	twclient "github.com/cconger/pulse/pkg/twitch"
+)
+
+var errUserNotFound = fmt.Errorf("no user found: %w", twclient.ErrNotFound)
+
+// UserBatchLoadingFunction resolves many users in one go. Keys without a user
+// are left out of the result rather than failing the batch.
+type UserBatchLoadingFunction func(ctx context.Context, keys []string) ([]*User, error)
+
+// userBatcher coalesces lookups made within a short window into a single call
+// to Load, so a burst of unknown @mentions costs one request instead of one
+// each.
+type userBatcher struct {
+	Load UserBatchLoadingFunction
+	// Normalize maps a key to the form results are matched on.
+	Normalize func(key string) string
+	// KeysOf lists the normalized keys a result answers.
+	KeysOf func(u *User) []string
+
+	Window   time.Duration
+	MaxBatch int
+	Timeout  time.Duration
+
+	mu      sync.Mutex
+	waiting map[string][]chan userResult
+	timer   *time.Timer
+}
+
+type userResult struct {
+	user *User
+	err  error
+}
+
+const (
+	defaultBatchWindow  = 50 * time.Millisecond
+	defaultBatchTimeout = 10 * time.Second
+)
+
+func newUserBatcher(load UserBatchLoadingFunction, normalize func(string) string, keysOf func(*User) []string) *userBatcher {
+	return &userBatcher{
+		Load:      load,
+		Normalize: normalize,
+		KeysOf:    keysOf,
+		Window:    defaultBatchWindow,
+		MaxBatch:  100,
+		Timeout:   defaultBatchTimeout,
+		waiting:   make(map[string][]chan userResult),
+	}
+}
+
+// Get queues key for the next batch and waits for its result.
+func (b *userBatcher) Get(ctx context.Context, key string) (*User, error) {
+	key = b.Normalize(key)
+	res := make(chan userResult, 1)
+
+	b.mu.Lock()
+	b.waiting[key] = append(b.waiting[key], res)
+	switch {
+	case len(b.waiting) >= b.MaxBatch:
+		go b.run(b.takeLocked())
+	case b.timer == nil:
+		b.timer = time.AfterFunc(b.Window, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case r := <-res:
+		return r.user, r.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (b *userBatcher) flush() {
+	b.mu.Lock()
+	batch := b.takeLocked()
+	b.mu.Unlock()
+	b.run(batch)
+}
+
+// takeLocked hands over everything waiting and resets the window.
+func (b *userBatcher) takeLocked() map[string][]chan userResult {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	batch := b.waiting
+	b.waiting = make(map[string][]chan userResult)
+	return batch
+}
+
+func (b *userBatcher) run(batch map[string][]chan userResult) {
+	if len(batch) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(batch))
+	for k := range batch {
+		keys = append(keys, k)
+	}
+
+	// Callers each have their own context, the batch can't use any one of them
+	ctx, cancel := context.WithTimeout(context.Background(), b.Timeout)
+	defer cancel()
+	users, err := b.Load(ctx, keys)
+
+	found := make(map[string]*User, len(users))
+	for _, u := range users {
+		for _, k := range b.KeysOf(u) {
+			found[k] = u
+		}
+	}
+
+	for k, waiters := range batch {
+		r := userResult{user: found[k], err: err}
+		if err == nil && r.user == nil {
+			r.err = errUserNotFound
+		}
+		for _, w := range waiters {
+			w <- r
+		}
+	}
+}
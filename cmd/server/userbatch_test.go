@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestUserBatcher(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		calls [][]string
+	)
+	b := newUserBatcher(func(ctx context.Context, keys []string) ([]*User, error) {
+		mu.Lock()
+		calls = append(calls, keys)
+		mu.Unlock()
+
+		var users []*User
+		for _, k := range keys {
+			if k != "ghost" {
+				users = append(users, &User{ID: "id-" + k, Login: k, DisplayName: k})
+			}
+		}
+		return users, nil
+	}, normalizeName, (*User).names)
+	b.Window = 20 * time.Millisecond
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"alice", "Bob", "alice", "ghost"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			u, err := b.Get(context.Background(), name)
+			switch {
+			case name == "ghost":
+				if !errors.Is(err, errUserNotFound) {
+					t.Errorf("expected ghost to be not found, got %v, %v", u, err)
+				}
+			case err != nil:
+				t.Errorf("loading %s: %v", name, err)
+			case u.Login != normalizeName(name):
+				t.Errorf("expected %s, got %+v", name, u)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if len(calls) != 1 || len(calls[0]) != 3 {
+		t.Errorf("expected a single batch of 3 keys, got %v", calls)
+	}
+}
+
+func TestUserBatcherMaxBatch(t *testing.T) {
+	calls := make(chan []string, 10)
+	b := newUserBatcher(func(ctx context.Context, keys []string) ([]*User, error) {
+		calls <- keys
+		return nil, fmt.Errorf("helix is down")
+	}, normalizeName, (*User).names)
+	b.Window = time.Hour
+	b.MaxBatch = 2
+
+	var wg sync.WaitGroup
+	for _, name := range []string{"alice", "bob"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := b.Get(context.Background(), name); err == nil || errors.Is(err, errUserNotFound) {
+				t.Errorf("expected the batch error for %s, got %v", name, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if keys := <-calls; len(keys) != 2 {
+		t.Errorf("expected a full batch to be sent without waiting, got %v", keys)
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errWALFull = errors.New("write-ahead log is full")
+
+const walSuffix = ".wal"
+
+// WALOverflowPolicy decides what happens when the log hits its size limit.
+type WALOverflowPolicy int
+
+const (
+	// WALRejectNew refuses new transactions until the backlog is replayed.
+	WALRejectNew WALOverflowPolicy = iota
+	// WALDropOldest deletes the oldest unreplayed segments to make room.
+	WALDropOldest
+)
+
+type walSegment struct {
+	Seq   uint64
+	Size  int64
+	Count int
+}
+
+// DurableSink appends transactions to a segmented log on disk and acknowledges
+// them immediately. A background loop rotates the active segment every
+// FlushInterval and replays closed segments to Downstream, backing off while
+// it is failing. Segments left over from a previous run are replayed on start.
+type DurableSink struct {
+	Dir           string
+	Downstream    BatchSink
+	MaxBytes      int64
+	Overflow      WALOverflowPolicy
+	FlushInterval time.Duration
+
+	mu        sync.Mutex
+	segments  []walSegment // closed segments, oldest first
+	active    *os.File
+	activeSeg walSegment
+	shipping  uint64
+	pending   int
+	closed    bool
+
+	shipCtx    context.Context
+	shipCancel context.CancelFunc
+	stop       chan struct{}
+	done       chan struct{}
+}
+
+func NewDurableSink(dir string, downstream BatchSink, maxBytes int64, overflow WALOverflowPolicy, flushInterval time.Duration) (*DurableSink, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("creating wal dir: %w", err)
+	}
+
+	d := &DurableSink{
+		Dir:           dir,
+		Downstream:    downstream,
+		MaxBytes:      maxBytes,
+		Overflow:      overflow,
+		FlushInterval: flushInterval,
+		stop:          make(chan struct{}),
+		done:          make(chan struct{}),
+	}
+	d.shipCtx, d.shipCancel = context.WithCancel(context.Background())
+
+	if err := d.recover(); err != nil {
+		return nil, err
+	}
+
+	var next uint64 = 1
+	if len(d.segments) > 0 {
+		next = d.segments[len(d.segments)-1].Seq + 1
+	}
+	if err := d.openSegment(next); err != nil {
+		return nil, err
+	}
+	d.updateMetrics()
+
+	go d.run()
+	return d, nil
+}
+
+func (d *DurableSink) segmentPath(seq uint64) string {
+	return filepath.Join(d.Dir, fmt.Sprintf("%016d%s", seq, walSuffix))
+}
+
+// recover loads any segments left on disk by a previous process.
+func (d *DurableSink) recover() error {
+	entries, err := os.ReadDir(d.Dir)
+	if err != nil {
+		return fmt.Errorf("reading wal dir: %w", err)
+	}
+
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, walSuffix) {
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, walSuffix), 10, 64)
+		if err != nil {
+			slog.Warn("ignoring unrecognized wal file", "file", name)
+			continue
+		}
+
+		contents, err := os.ReadFile(filepath.Join(d.Dir, name))
+		if err != nil {
+			return fmt.Errorf("reading wal segment %s: %w", name, err)
+		}
+		if len(contents) == 0 {
+			os.Remove(filepath.Join(d.Dir, name))
+			continue
+		}
+
+		seg := walSegment{
+			Seq:   seq,
+			Size:  int64(len(contents)),
+			Count: bytes.Count(contents, []byte{'\n'}),
+		}
+		d.segments = append(d.segments, seg)
+		d.pending += seg.Count
+	}
+
+	sort.Slice(d.segments, func(i, j int) bool {
+		return d.segments[i].Seq < d.segments[j].Seq
+	})
+
+	if len(d.segments) > 0 {
+		slog.Info("recovered wal segments", "segments", len(d.segments), "transactions", d.pending)
+	}
+	return nil
+}
+
+// openSegment must be called with mu held or before the sink is shared.
+func (d *DurableSink) openSegment(seq uint64) error {
+	f, err := os.OpenFile(d.segmentPath(seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return fmt.Errorf("opening wal segment: %w", err)
+	}
+	d.active = f
+	d.activeSeg = walSegment{Seq: seq}
+	return nil
+}
+
+func (d *DurableSink) Insert(ctx context.Context, t Transaction) error {
+	line, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.closed {
+		return errSinkClosed
+	}
+
+	if d.MaxBytes > 0 && d.sizeLocked()+int64(len(line)) > d.MaxBytes {
+		if d.Overflow == WALDropOldest {
+			d.dropOldestLocked(int64(len(line)))
+		}
+		if d.sizeLocked()+int64(len(line)) > d.MaxBytes {
+			walDropped.WithLabelValues("rejected").Inc()
+			return errWALFull
+		}
+	}
+
+	if _, err := d.active.Write(line); err != nil {
+		return fmt.Errorf("writing wal: %w", err)
+	}
+	if err := d.active.Sync(); err != nil {
+		return fmt.Errorf("syncing wal: %w", err)
+	}
+
+	d.activeSeg.Size += int64(len(line))
+	d.activeSeg.Count++
+	d.pending++
+	d.updateMetrics()
+	return nil
+}
+
+// Len is the number of transactions that haven't been replayed downstream.
+func (d *DurableSink) Len() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.pending
+}
+
+// Close stops accepting transactions and makes a final attempt to replay the
+// log until ctx expires. Anything left stays on disk for the next start.
+func (d *DurableSink) Close(ctx context.Context) error {
+	d.mu.Lock()
+	if !d.closed {
+		d.closed = true
+		close(d.stop)
+	}
+	d.mu.Unlock()
+
+	select {
+	case <-d.done:
+		return nil
+	case <-ctx.Done():
+		d.shipCancel()
+		<-d.done
+		return ctx.Err()
+	}
+}
+
+func (d *DurableSink) sizeLocked() int64 {
+	size := d.activeSeg.Size
+	for _, s := range d.segments {
+		size += s.Size
+	}
+	return size
+}
+
+// dropOldestLocked deletes closed segments until need bytes are free. The
+// segment currently being replayed is never dropped.
+func (d *DurableSink) dropOldestLocked(need int64) {
+	for i := 0; i < len(d.segments) && d.sizeLocked()+need > d.MaxBytes; {
+		seg := d.segments[i]
+		if seg.Seq == d.shipping {
+			i++
+			continue
+		}
+		if err := os.Remove(d.segmentPath(seg.Seq)); err != nil && !os.IsNotExist(err) {
+			slog.Error("dropping wal segment", "seq", seg.Seq, "err", err)
+			return
+		}
+		slog.Warn("wal full, dropped segment", "seq", seg.Seq, "transactions", seg.Count)
+		walDropped.WithLabelValues("overflow").Add(float64(seg.Count))
+		d.pending -= seg.Count
+		d.segments = append(d.segments[:i], d.segments[i+1:]...)
+	}
+}
+
+func (d *DurableSink) run() {
+	defer close(d.done)
+
+	ticker := time.NewTicker(d.FlushInterval)
+	defer ticker.Stop()
+
+	var (
+		backoff time.Duration
+		retryAt time.Time
+	)
+	for {
+		stopping := false
+		select {
+		case <-ticker.C:
+		case <-d.stop:
+			stopping = true
+		}
+
+		if err := d.rotate(); err != nil {
+			slog.Error("rotating wal segment", "err", err)
+		}
+
+		if stopping || !time.Now().Before(retryAt) {
+			if err := d.replay(); err != nil {
+				walReplayErrors.Inc()
+				backoff = min(max(2*backoff, time.Second), time.Minute)
+				retryAt = time.Now().Add(backoff)
+				slog.Error("replaying wal", "err", err, "retryIn", backoff)
+			} else {
+				backoff = 0
+			}
+		}
+
+		if stopping {
+			d.mu.Lock()
+			d.active.Close()
+			if d.activeSeg.Count == 0 {
+				os.Remove(d.segmentPath(d.activeSeg.Seq))
+			}
+			d.mu.Unlock()
+			return
+		}
+	}
+}
+
+// rotate closes the active segment if it has anything in it and opens a new one.
+func (d *DurableSink) rotate() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.activeSeg.Count == 0 {
+		return nil
+	}
+	if err := d.active.Close(); err != nil {
+		return err
+	}
+	d.segments = append(d.segments, d.activeSeg)
+	return d.openSegment(d.activeSeg.Seq + 1)
+}
+
+// replay sends closed segments downstream oldest first, stopping at the first
+// failure so ordering is preserved.
+func (d *DurableSink) replay() error {
+	for {
+		d.mu.Lock()
+		if len(d.segments) == 0 {
+			d.mu.Unlock()
+			return nil
+		}
+		seg := d.segments[0]
+		d.shipping = seg.Seq
+		d.mu.Unlock()
+
+		err := d.ship(seg)
+
+		d.mu.Lock()
+		d.shipping = 0
+		if err == nil {
+			d.removeSegmentLocked(seg)
+		}
+		d.updateMetrics()
+		d.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (d *DurableSink) ship(seg walSegment) error {
+	f, err := os.Open(d.segmentPath(seg.Seq))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ts := make([]Transaction, 0, seg.Count)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var t Transaction
+		if err := json.Unmarshal(scanner.Bytes(), &t); err != nil {
+			// A torn write from a crash, nothing to recover here.
+			slog.Warn("skipping corrupt wal record", "seq", seg.Seq, "err", err)
+			walDropped.WithLabelValues("corrupt").Inc()
+			continue
+		}
+		ts = append(ts, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	if len(ts) == 0 {
+		return nil
+	}
+	return d.Downstream.InsertBatch(d.shipCtx, ts)
+}
+
+func (d *DurableSink) removeSegmentLocked(seg walSegment) {
+	for i, s := range d.segments {
+		if s.Seq == seg.Seq {
+			d.segments = append(d.segments[:i], d.segments[i+1:]...)
+			d.pending -= seg.Count
+			break
+		}
+	}
+	if err := os.Remove(d.segmentPath(seg.Seq)); err != nil && !os.IsNotExist(err) {
+		slog.Error("removing replayed wal segment", "seq", seg.Seq, "err", err)
+	}
+}
+
+func (d *DurableSink) updateMetrics() {
+	walBytes.Set(float64(d.sizeLocked()))
+	walPending.Set(float64(d.pending))
+}
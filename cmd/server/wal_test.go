@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+type fakeBatchSink struct {
+	mu      sync.Mutex
+	fail    bool
+	got     []Transaction
+	batches []int
+}
+
+func (f *fakeBatchSink) InsertBatch(ctx context.Context, ts []Transaction) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fail {
+		return errors.New("downstream unavailable")
+	}
+	f.got = append(f.got, ts...)
+	f.batches = append(f.batches, len(ts))
+	return nil
+}
+
+func (f *fakeBatchSink) setFail(fail bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeBatchSink) received() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.got)
+}
+
+func testTransaction(v int) Transaction {
+	return Transaction{
+		Channel:    "1",
+		Source:     "2",
+		TargetUser: "1",
+		Value:      v,
+		Timestamp:  time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC),
+	}
+}
+
+func TestDurableSinkRecovery(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	down := &fakeBatchSink{fail: true}
+
+	d, err := NewDurableSink(dir, down, 0, WALRejectNew, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := d.Insert(ctx, testTransaction(1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	closeCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	d.Close(closeCtx)
+	if down.received() != 0 {
+		t.Fatalf("expected nothing downstream, got %d", down.received())
+	}
+
+	// A new sink over the same dir should pick up where the last one left off.
+	down.setFail(false)
+	d, err = NewDurableSink(dir, down, 0, WALRejectNew, 10*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Len() != 3 {
+		t.Fatalf("expected 3 recovered transactions, got %d", d.Len())
+	}
+	if err := d.Insert(ctx, testTransaction(-1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	if down.received() != 4 {
+		t.Fatalf("expected 4 transactions downstream, got %d", down.received())
+	}
+	if down.got[3].Value != -1 {
+		t.Errorf("expected replay in order, got %+v", down.got)
+	}
+}
+
+func TestDurableSinkOverflow(t *testing.T) {
+	ctx := context.Background()
+	down := &fakeBatchSink{fail: true}
+
+	d, err := NewDurableSink(t.TempDir(), down, 200, WALRejectNew, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close(ctx)
+
+	var rejected error
+	for i := 0; i < 10 && rejected == nil; i++ {
+		rejected = d.Insert(ctx, testTransaction(1))
+	}
+	if !errors.Is(rejected, errWALFull) {
+		t.Fatalf("expected errWALFull, got %v", rejected)
+	}
+}
+
+func TestDurableSinkDropOldest(t *testing.T) {
+	ctx := context.Background()
+	down := &fakeBatchSink{fail: true}
+
+	line, err := json.Marshal(testTransaction(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Room for three records, each in a segment of its own
+	d, err := NewDurableSink(t.TempDir(), down, 3*int64(len(line)+1), WALDropOldest, 5*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i <= 5; i++ {
+		if err := d.Insert(ctx, testTransaction(i)); err != nil {
+			t.Fatalf("insert %d: %v", i, err)
+		}
+		waitFor(t, func() bool {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			return d.activeSeg.Count == 0
+		})
+	}
+	if d.Len() != 3 {
+		t.Fatalf("expected the oldest transactions to be dropped, have %d", d.Len())
+	}
+
+	down.setFail(false)
+	if err := d.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	var got []int
+	for _, t := range down.got {
+		got = append(got, t.Value)
+	}
+	if !cmp.Equal(got, []int{3, 4, 5}) {
+		t.Errorf("expected the newest transactions to be replayed, got %v", got)
+	}
+}
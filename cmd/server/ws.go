@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// WebSocketHandler lets a single connection follow votes across several
+// channels. Clients send JSON control messages:
+//
+//	{"type":"subscribe","channel":"39214310"}
+//	{"type":"subscribe","channel":"39214310","user":"1234"}
+//	{"type":"subscribe","channel":"39214310","topic":"pokemon"}
+//	{"type":"unsubscribe","channel":"39214310"}
+//	{"type":"ping"}
+//
+// A subscription with a user or topic only receives votes for that target in
+// the channel. Votes are delivered as {"type":"vote","id":...,"transaction":...}.
+type WebSocketHandler struct {
+	PubSub           *PubSubMiddleware
+	PingInterval     time.Duration
+	MaxSubscriptions int
+
+	upgrader websocket.Upgrader
+}
+
+func NewWebSocketHandler(ps *PubSubMiddleware, pingInterval time.Duration, maxSubscriptions int) *WebSocketHandler {
+	return &WebSocketHandler{
+		PubSub:           ps,
+		PingInterval:     pingInterval,
+		MaxSubscriptions: maxSubscriptions,
+		upgrader: websocket.Upgrader{
+			// Overlays are served from all over the place, the stream is public.
+			CheckOrigin: func(r *http.Request) bool { return true },
+		},
+	}
+}
+
+type wsSubscription struct {
+	Channel string `json:"channel"`
+	User    string `json:"user,omitempty"`
+	Topic   string `json:"topic,omitempty"`
+}
+
+func (s wsSubscription) matches(t Transaction) bool {
+	if s.User != "" && (t.TargetUser != s.User || t.TargetTopic != "") {
+		return false
+	}
+	if s.Topic != "" && t.TargetTopic != s.Topic {
+		return false
+	}
+	return true
+}
+
+type wsClientMessage struct {
+	Type string `json:"type"`
+	wsSubscription
+}
+
+type wsServerMessage struct {
+	Type         string          `json:"type"`
+	ID           uint64          `json:"id,omitempty"`
+	Subscription *wsSubscription `json:"subscription,omitempty"`
+	Transaction  *Transaction    `json:"transaction,omitempty"`
+	Error        string          `json:"error,omitempty"`
+}
+
+type wsConn struct {
+	handler *WebSocketHandler
+	conn    *websocket.Conn
+	out     chan wsServerMessage
+	ctx     context.Context
+
+	mu            sync.Mutex
+	subscriptions map[wsSubscription]bool
+	channels      map[string]wsChannel
+}
+
+type wsChannel struct {
+	events chan Event
+	unsub  func() error
+}
+
+func (h *WebSocketHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// Upgrade has already written the error response
+		slog.Debug("upgrading websocket", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	c := &wsConn{
+		handler:       h,
+		conn:          conn,
+		out:           make(chan wsServerMessage, 64),
+		ctx:           ctx,
+		subscriptions: make(map[wsSubscription]bool),
+		channels:      make(map[string]wsChannel),
+	}
+	defer c.unsubscribeAll()
+
+	go c.writeLoop(cancel)
+	c.readLoop()
+}
+
+func (c *wsConn) readLoop() {
+	deadline := 2 * c.handler.PingInterval
+	c.conn.SetReadLimit(4096)
+	c.conn.SetReadDeadline(time.Now().Add(deadline))
+	c.conn.SetPongHandler(func(string) error {
+		return c.conn.SetReadDeadline(time.Now().Add(deadline))
+	})
+
+	for {
+		var msg wsClientMessage
+		if err := c.conn.ReadJSON(&msg); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				slog.Debug("reading websocket", "err", err)
+			}
+			return
+		}
+		c.conn.SetReadDeadline(time.Now().Add(deadline))
+
+		switch msg.Type {
+		case "subscribe":
+			if err := c.subscribe(msg.wsSubscription); err != nil {
+				c.send(wsServerMessage{Type: "error", Error: err.Error()})
+				continue
+			}
+			c.send(wsServerMessage{Type: "subscribed", Subscription: &msg.wsSubscription})
+		case "unsubscribe":
+			c.unsubscribe(msg.wsSubscription)
+			c.send(wsServerMessage{Type: "unsubscribed", Subscription: &msg.wsSubscription})
+		case "ping":
+			c.send(wsServerMessage{Type: "pong"})
+		default:
+			c.send(wsServerMessage{Type: "error", Error: fmt.Sprintf("unknown message type %q", msg.Type)})
+		}
+	}
+}
+
+func (c *wsConn) writeLoop(cancel context.CancelFunc) {
+	defer cancel()
+
+	ticker := time.NewTicker(c.handler.PingInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.ctx.Done():
+			c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+			return
+		case <-ticker.C:
+			if err := c.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(10*time.Second)); err != nil {
+				return
+			}
+		case msg := <-c.out:
+			c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
+			if err := c.conn.WriteJSON(msg); err != nil {
+				slog.Debug("writing websocket", "err", err)
+				// Unblock the reader so the handler returns
+				c.conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// send queues a message for the writer, giving up if the connection is gone.
+func (c *wsConn) send(msg wsServerMessage) bool {
+	select {
+	case c.out <- msg:
+		return true
+	case <-c.ctx.Done():
+		return false
+	}
+}
+
+func (c *wsConn) subscribe(sub wsSubscription) error {
+	if sub.Channel == "" {
+		return fmt.Errorf("channel is required")
+	}
+	if sub.User != "" && sub.Topic != "" {
+		return fmt.Errorf("subscribe to a user or a topic, not both")
+	}
+	sub.Topic = normalizeName(sub.Topic)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.subscriptions[sub] {
+		return nil
+	}
+	if len(c.subscriptions) >= c.handler.MaxSubscriptions {
+		return fmt.Errorf("too many subscriptions, limit is %d", c.handler.MaxSubscriptions)
+	}
+	c.subscriptions[sub] = true
+
+	if _, ok := c.channels[sub.Channel]; !ok {
+		events, unsub := c.handler.PubSub.Subscribe(c.ctx, sub.Channel)
+		c.channels[sub.Channel] = wsChannel{events: events, unsub: unsub}
+		go c.forward(sub.Channel, events)
+	}
+	return nil
+}
+
+func (c *wsConn) unsubscribe(sub wsSubscription) {
+	sub.Topic = normalizeName(sub.Topic)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.subscriptions, sub)
+
+	for s := range c.subscriptions {
+		if s.Channel == sub.Channel {
+			return
+		}
+	}
+	// Nothing left in this channel, drop the pubsub subscription
+	if ch, ok := c.channels[sub.Channel]; ok {
+		ch.unsub()
+		delete(c.channels, sub.Channel)
+	}
+}
+
+func (c *wsConn) unsubscribeAll() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for channel, ch := range c.channels {
+		ch.unsub()
+		delete(c.channels, channel)
+	}
+}
+
+// forward relays events for a channel until the pubsub subscription closes.
+func (c *wsConn) forward(channel string, events chan Event) {
+	for e := range events {
+		if !c.wanted(e.Transaction) {
+			continue
+		}
+		t := e.Transaction
+		if !c.send(wsServerMessage{Type: "vote", ID: e.ID, Transaction: &t}) {
+			return
+		}
+	}
+
+	// If we still think we're subscribed, pubsub disconnected us for falling
+	// behind. Forget the channel and let the client know.
+	c.mu.Lock()
+	ch, ok := c.channels[channel]
+	dropped := ok && ch.events == events
+	if dropped {
+		delete(c.channels, channel)
+		for s := range c.subscriptions {
+			if s.Channel == channel {
+				delete(c.subscriptions, s)
+			}
+		}
+	}
+	c.mu.Unlock()
+
+	if dropped {
+		c.send(wsServerMessage{Type: "error", Error: fmt.Sprintf("disconnected from %s for falling behind", channel)})
+	}
+}
+
+func (c *wsConn) wanted(t Transaction) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for s := range c.subscriptions {
+		if s.Channel == t.Channel && s.matches(t) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+func TestWebSocketFanOut(t *testing.T) {
+	ctx := context.Background()
+	ps := NewPubSubMiddleware(&PrintSink{}, 10, DropOldest, 0)
+	srv := httptest.NewServer(NewWebSocketHandler(ps, time.Minute, 2))
+	defer srv.Close()
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	roundTrip := func(msg wsClientMessage) wsServerMessage {
+		t.Helper()
+		if err := conn.WriteJSON(msg); err != nil {
+			t.Fatal(err)
+		}
+		return readWS(t, conn)
+	}
+
+	if got := roundTrip(wsClientMessage{Type: "ping"}); got.Type != "pong" {
+		t.Errorf("expected pong, got %+v", got)
+	}
+	if got := roundTrip(wsClientMessage{Type: "subscribe", wsSubscription: wsSubscription{Channel: "1", User: "3"}}); got.Type != "subscribed" {
+		t.Fatalf("expected subscribed, got %+v", got)
+	}
+	if got := roundTrip(wsClientMessage{Type: "subscribe", wsSubscription: wsSubscription{Channel: "2"}}); got.Type != "subscribed" {
+		t.Fatalf("expected subscribed, got %+v", got)
+	}
+	if got := roundTrip(wsClientMessage{Type: "subscribe", wsSubscription: wsSubscription{Channel: "3"}}); got.Type != "error" {
+		t.Errorf("expected the subscription limit to be enforced, got %+v", got)
+	}
+	if got := roundTrip(wsClientMessage{Type: "dance"}); got.Type != "error" {
+		t.Errorf("expected an error for an unknown message, got %+v", got)
+	}
+
+	for _, v := range []Transaction{
+		{Channel: "1", TargetUser: "4", Value: 1},
+		{Channel: "1", TargetUser: "3", Value: 2},
+		{Channel: "3", TargetUser: "3", Value: 3},
+		{Channel: "2", TargetTopic: "pizza", Value: 4},
+	} {
+		if err := ps.Insert(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Channels are forwarded independently, so only order within one is kept
+	var got []int
+	for i := 0; i < 2; i++ {
+		if msg := readWS(t, conn); msg.Type == "vote" {
+			got = append(got, msg.Transaction.Value)
+		}
+	}
+	slices.Sort(got)
+	if !slices.Equal(got, []int{2, 4}) {
+		t.Errorf("expected votes 2 and 4, got %v", got)
+	}
+
+	if got := roundTrip(wsClientMessage{Type: "unsubscribe", wsSubscription: wsSubscription{Channel: "2"}}); got.Type != "unsubscribed" {
+		t.Fatalf("expected unsubscribed, got %+v", got)
+	}
+	for _, v := range []Transaction{
+		{Channel: "2", TargetUser: "3", Value: 5},
+		{Channel: "1", TargetUser: "3", Value: 6},
+	} {
+		if err := ps.Insert(ctx, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readWS(t, conn); got.Type != "vote" || got.Transaction.Value != 6 {
+		t.Errorf("expected only votes still subscribed to, got %+v", got)
+	}
+}
+
+func readWS(t *testing.T, conn *websocket.Conn) wsServerMessage {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	var msg wsServerMessage
+	if err := conn.ReadJSON(&msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
@@ -0,0 +1,108 @@
+package twitch
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+type roundTripFunc func(r *http.Request) (*http.Response, error)
+
+// RoundTrip sets the request on the response like a real transport does.
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	resp, err := f(r)
+	if resp != nil {
+		resp.Request = r
+	}
+	return resp, err
+}
+
+func jsonResponse(status int, body string) *http.Response {
+	return &http.Response{
+		StatusCode: status,
+		Status:     http.StatusText(status),
+		Header:     http.Header{"Content-Type": []string{"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+func TestUserTokenRefreshOn401(t *testing.T) {
+	var helixCalls, refreshes int
+	httpClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "id.twitch.tv" {
+			refreshes++
+			if err := r.ParseForm(); err != nil {
+				t.Fatal(err)
+			}
+			if r.PostForm.Get("refresh_token") != "refresh-1" {
+				return jsonResponse(http.StatusUnauthorized, `{}`), nil
+			}
+			return jsonResponse(http.StatusOK, `{"access_token":"access-2","refresh_token":"refresh-2","expires_in":14400}`), nil
+		}
+
+		helixCalls++
+		if r.Header.Get("Authorization") != "Bearer access-2" {
+			return jsonResponse(http.StatusUnauthorized, `{"status":401,"message":"Invalid OAuth token"}`), nil
+		}
+		return jsonResponse(http.StatusOK, `{"data":[{"id":"1","login":"alice","display_name":"Alice"}]}`), nil
+	})}
+
+	c, err := NewClient("id", "secret", httpClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var persisted []string
+	ua := &UserAuth{
+		AccessToken:  "access-1",
+		RefreshToken: "refresh-1",
+		OnRefresh: func(ctx context.Context, access, refresh string) {
+			persisted = append(persisted, access, refresh)
+		},
+	}
+	u, err := c.UserClient(ua).GetUser(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Login != "alice" {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if helixCalls != 2 || refreshes != 1 {
+		t.Errorf("expected one refresh and a single retry, got %d refreshes and %d calls", refreshes, helixCalls)
+	}
+	if len(persisted) != 2 || persisted[0] != "access-2" || persisted[1] != "refresh-2" {
+		t.Errorf("expected the new token pair to be persisted, got %v", persisted)
+	}
+
+	// Once the refresh token is revoked we give up instead of looping
+	ua.AccessToken = "revoked"
+	ua.RefreshToken = "revoked"
+	if _, err := c.UserClient(ua).GetUser(context.Background()); !errors.Is(err, ErrUnauthorized) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+}
+
+func TestUserTokenRefreshFailure(t *testing.T) {
+	httpClient := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		if r.URL.Host == "id.twitch.tv" {
+			return jsonResponse(http.StatusServiceUnavailable, `{}`), nil
+		}
+		return jsonResponse(http.StatusUnauthorized, `{"status":401,"message":"Invalid OAuth token"}`), nil
+	})}
+
+	c, err := NewClient("id", "secret", httpClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Twitch being down doesn't mean the credentials are bad
+	ua := &UserAuth{AccessToken: "access-1", RefreshToken: "refresh-1"}
+	_, err = c.UserClient(ua).GetUser(context.Background())
+	var apiErr *APIError
+	if errors.Is(err, ErrUnauthorized) || !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("expected the refresh failure, got %v", err)
+	}
+}
@@ -10,12 +10,10 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
 )
 
-var (
-	errForbidden     = errors.New("forbidden")
-	errCannotRefresh = errors.New("cannot refresh")
-)
+var errCannotRefresh = errors.New("cannot refresh")
 
 type TwitchClient interface {
 	OAuthGetToken(context.Context, string, string) (*GetTokenResponse, error)
@@ -27,81 +25,167 @@ type UserClient interface {
 	GetUser(context.Context) (*TwitchUser, error)
 }
 
+// Default endpoints, override them on the Client to talk to something else
+// like twitchtest.
+const (
+	DefaultHelixURL = "https://api.twitch.tv/helix"
+	DefaultOAuthURL = "https://id.twitch.tv/oauth2"
+)
+
 type Client struct {
 	Client       *http.Client
 	ClientID     string
 	ClientSecret string
+	HelixURL     string
+	OAuthURL     string
+	// MaxRetries is how many times a request is repeated after a 429 or 5xx.
+	MaxRetries int
 
-	auth AuthProvider
+	auth    AuthProvider
+	limiter *rateLimiter
 }
 
+const defaultMaxRetries = 3
+
+// AuthProvider supplies the bearer token for helix requests.
 type AuthProvider interface {
-	Token() (string, error)
-	Refresh()
+	Token(ctx context.Context) (string, error)
+	// Refresh replaces the token after helix rejected it. stale is the token
+	// that was rejected, if it has already been replaced nothing is done so
+	// concurrent requests don't each refresh.
+	Refresh(ctx context.Context, stale string) error
 }
 
+// tokenExpiryMargin renews app tokens a little before twitch expires them.
+const tokenExpiryMargin = time.Minute
+
 type AppAuth struct {
 	ID     string
 	Secret string
+	// Client makes the token requests, and its OAuthURL is used.
+	Client *Client
 
-	once sync.Once
-	t    string
+	mu      sync.Mutex
+	t       string
+	expires time.Time
 }
 
-func (a *AppAuth) Token() (string, error) {
-	var err error
-	a.once.Do(func() {
-		a.t, err = a.getToken()
-		if err != nil {
-			slog.Error("getting appToken", "err", err)
-			a.once = sync.Once{}
-		}
-	})
-	return a.t, err
+func (a *AppAuth) Token(ctx context.Context) (string, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.t != "" && time.Now().Before(a.expires) {
+		return a.t, nil
+	}
+	return a.renewLocked(ctx)
+}
+
+func (a *AppAuth) Refresh(ctx context.Context, stale string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.t != stale {
+		return nil
+	}
+	_, err := a.renewLocked(ctx)
+	return err
 }
 
-func (a *AppAuth) getToken() (string, error) {
+func (a *AppAuth) renewLocked(ctx context.Context) (string, error) {
+	tokenResp, err := a.getToken(ctx)
+	if err != nil {
+		slog.Error("getting appToken", "err", err)
+		return "", err
+	}
+	a.t = tokenResp.AccessToken
+	a.expires = time.Now().Add(time.Duration(tokenResp.ExpiresIn)*time.Second - tokenExpiryMargin)
+	if tokenResp.ExpiresIn == 0 {
+		// Keep it until helix rejects it
+		a.expires = time.Now().Add(24 * time.Hour)
+	}
+	return a.t, nil
+}
+
+func (a *AppAuth) getToken(ctx context.Context) (*GetTokenResponse, error) {
 	slog.Info("getting appToken")
 	params := url.Values{}
 	params.Add("client_id", a.ID)
 	params.Add("client_secret", a.Secret)
 	params.Add("grant_type", "client_credentials")
 
-	req, err := http.NewRequest(http.MethodPost, "https://id.twitch.tv/oauth2/token", strings.NewReader(params.Encode()))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, a.Client.OAuthURL+"/token", strings.NewReader(params.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("creating oauth request: %w", err)
+		return nil, fmt.Errorf("creating oauth request: %w", err)
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := a.Client.Client.Do(req)
 	if err != nil {
-		return "", fmt.Errorf("post oauth request: %w", err)
+		return nil, fmt.Errorf("post oauth request: %w", err)
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
 	var tokenResp GetTokenResponse
 	err = json.NewDecoder(resp.Body).Decode(&tokenResp)
 	if err != nil {
-		return "", fmt.Errorf("deserializing oauth: %w", err)
+		return nil, fmt.Errorf("deserializing oauth: %w", err)
 	}
 
-	return tokenResp.AccessToken, nil
-}
-
-func (a *AppAuth) Refresh() {
-	a.once = sync.Once{}
+	return &tokenResp, nil
 }
 
 type UserAuth struct {
 	AccessToken  string
 	RefreshToken string
+	// OnRefresh is called with the new token pair after a refresh, so it can
+	// be persisted. The old refresh token stops working. It's called without
+	// any lock held, so it's free to use the UserAuth.
+	OnRefresh func(ctx context.Context, accessToken string, refreshToken string)
+
+	mu      sync.Mutex
+	refresh func(ctx context.Context, ua *UserAuth) (*GetTokenResponse, error)
 }
 
-func (ua *UserAuth) Token() (string, error) {
+func (ua *UserAuth) Token(ctx context.Context) (string, error) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
 	return ua.AccessToken, nil
 }
 
-func (ua *UserAuth) Refresh() {
-	slog.Warn("refreshing user token not implemented")
+func (ua *UserAuth) Refresh(ctx context.Context, stale string) error {
+	access, refresh, err := ua.swapTokens(ctx, stale)
+	if err != nil || access == "" {
+		return err
+	}
+	if ua.OnRefresh != nil {
+		ua.OnRefresh(ctx, access, refresh)
+	}
+	return nil
+}
+
+// swapTokens swaps in a new token pair unless stale was already replaced,
+// in which case it returns empty tokens.
+func (ua *UserAuth) swapTokens(ctx context.Context, stale string) (string, string, error) {
+	ua.mu.Lock()
+	defer ua.mu.Unlock()
+	if ua.AccessToken != stale {
+		return "", "", nil
+	}
+	if ua.refresh == nil {
+		return "", "", errCannotRefresh
+	}
+
+	resp, err := ua.refresh(ctx, ua)
+	if err != nil {
+		return "", "", fmt.Errorf("refreshing user token: %w", err)
+	}
+	ua.AccessToken = resp.AccessToken
+	if resp.RefreshToken != "" {
+		ua.RefreshToken = resp.RefreshToken
+	}
+	return ua.AccessToken, ua.RefreshToken, nil
 }
 
 func NewClient(clientID string, clientSecret string, httpClient *http.Client) (*Client, error) {
@@ -113,45 +197,121 @@ func NewClient(clientID string, clientSecret string, httpClient *http.Client) (*
 		return nil, fmt.Errorf("client secret cannot be empty")
 	}
 
-	return &Client{
+	c := &Client{
 		Client:       httpClient,
 		ClientID:     clientID,
 		ClientSecret: clientSecret,
-		auth: &AppAuth{
-			ID:     clientID,
-			Secret: clientSecret,
-		},
-	}, nil
+		HelixURL:     DefaultHelixURL,
+		OAuthURL:     DefaultOAuthURL,
+		MaxRetries:   defaultMaxRetries,
+		limiter:      newRateLimiter(),
+	}
+	c.auth = &AppAuth{
+		ID:     clientID,
+		Secret: clientSecret,
+		Client: c,
+	}
+	return c, nil
 }
 
+// UserClient makes requests on behalf of a user. The token is refreshed
+// through c when it expires.
 func (c *Client) UserClient(ua *UserAuth) UserClient {
+	ua.mu.Lock()
+	ua.refresh = c.OAuthRefreshToken
+	ua.mu.Unlock()
+
 	return &Client{
 		Client:       c.Client,
 		ClientID:     c.ClientID,
 		ClientSecret: c.ClientSecret,
+		HelixURL:     c.HelixURL,
+		OAuthURL:     c.OAuthURL,
+		MaxRetries:   c.MaxRetries,
 		auth:         ua,
+		// User tokens have a bucket of their own
+		limiter: newRateLimiter(),
 	}
 }
 
+// RateLimitRemaining is how many requests are left in the current helix rate
+// limit window, or -1 if no request has been made yet.
+func (c *Client) RateLimitRemaining() int {
+	return c.limiter.Remaining()
+}
+
+// do sends an authenticated helix request, waiting for the rate limit and
+// retrying 429s and 5xxs with backoff until the request's context runs out.
+// A 401 refreshes the token and retries once. Only a refresh twitch rejects
+// is reported as ErrUnauthorized.
 func (c *Client) do(req *http.Request) (*http.Response, error) {
-	token, err := c.auth.Token()
-	if err != nil {
-		return nil, err
-	}
+	ctx := req.Context()
+	refreshed := false
+	for attempt := 0; ; attempt++ {
+		if err := c.limiter.wait(ctx); err != nil {
+			return nil, err
+		}
+
+		token, err := c.auth.Token(ctx)
+		if err != nil {
+			return nil, err
+		}
 
-	req.Header.Add("Authorization", fmt.Sprintf("Bearer %s", token))
-	req.Header.Add("Client-Id", c.ClientID)
+		r := req.Clone(ctx)
+		r.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+		r.Header.Set("Client-Id", c.ClientID)
 
-	resp, err := c.Client.Do(req)
-	if err != nil {
-		return resp, err
-	}
+		resp, err := c.Client.Do(r)
+		if err != nil {
+			return resp, err
+		}
+		c.limiter.update(resp.Header)
+
+		if resp.StatusCode == http.StatusUnauthorized && !refreshed {
+			resp.Body.Close()
+			if err := c.auth.Refresh(ctx, token); err != nil {
+				if refreshRejected(err) {
+					return nil, fmt.Errorf("%w: %w", ErrUnauthorized, err)
+				}
+				return nil, err
+			}
+			refreshed = true
+			// Doesn't count towards the retries
+			attempt--
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		apiErr := newAPIError(resp)
+		resp.Body.Close()
+		if !apiErr.Temporary() {
+			return nil, apiErr
+		}
+		if attempt >= c.MaxRetries {
+			return nil, fmt.Errorf("giving up after %d attempts: %w", attempt+1, apiErr)
+		}
 
-	if resp.StatusCode == http.StatusForbidden {
-		return resp, errForbidden
+		delay := max(backoff(attempt), apiErr.RetryAfter)
+		slog.Warn("retrying helix request", "path", req.URL.Path, "status", resp.StatusCode, "attempt", attempt+1, "delay", delay)
+		if err := sleep(ctx, delay); err != nil {
+			return nil, fmt.Errorf("%w, not retrying: %w", apiErr, err)
+		}
 	}
+}
 
-	return resp, err
+// refreshRejected reports whether a failed refresh means the credentials are
+// no good, rather than twitch being unreachable or failing.
+func refreshRejected(err error) bool {
+	if errors.Is(err, errCannotRefresh) {
+		return true
+	}
+	var apiErr *APIError
+	if errors.As(err, &apiErr) {
+		return apiErr.StatusCode == http.StatusBadRequest || apiErr.StatusCode == http.StatusUnauthorized
+	}
+	return false
 }
 
 func (c *Client) authHeaders(r *http.Request) *http.Request {
@@ -175,10 +335,11 @@ func (c *Client) OAuthGetToken(ctx context.Context, code string, redirectURI str
 		"redirect_uri":  []string{redirectURI},
 	}
 
-	r, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://id.twitch.tv/oauth2/token", strings.NewReader(payload.Encode()))
+	r, err := http.NewRequestWithContext(ctx, http.MethodPost, c.OAuthURL+"/token", strings.NewReader(payload.Encode()))
 	if err != nil {
 		return nil, err
 	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := c.Client.Do(r)
 	if err != nil {
@@ -186,6 +347,10 @@ func (c *Client) OAuthGetToken(ctx context.Context, code string, redirectURI str
 	}
 	defer resp.Body.Close()
 
+	if resp.StatusCode != http.StatusOK {
+		return nil, newAPIError(resp)
+	}
+
 	var response GetTokenResponse
 	err = json.NewDecoder(resp.Body).Decode(&response)
 	if err != nil {
@@ -206,12 +371,13 @@ func (c *Client) OAuthRefreshToken(ctx context.Context, ua *UserAuth) (*GetToken
 	r, err := http.NewRequestWithContext(
 		ctx,
 		http.MethodPost,
-		"https://id.twitch.tv/oauth2/token",
+		c.OAuthURL+"/token",
 		strings.NewReader(payload.Encode()),
 	)
 	if err != nil {
 		return nil, err
 	}
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
 	resp, err := c.Client.Do(r)
 	if err != nil {
@@ -219,8 +385,10 @@ func (c *Client) OAuthRefreshToken(ctx context.Context, ua *UserAuth) (*GetToken
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode == http.StatusUnauthorized {
-		return nil, errCannotRefresh
+	if resp.StatusCode != http.StatusOK {
+		// Twitch answers 400 for a refresh token that's been revoked or used,
+		// which do reports as ErrUnauthorized
+		return nil, newAPIError(resp)
 	}
 
 	var response GetTokenResponse
@@ -248,55 +416,73 @@ func (c *Client) GetUser(ctx context.Context) (*TwitchUser, error) {
 		return nil, err
 	}
 	if len(users) < 1 {
-		return nil, fmt.Errorf("twitch user not found")
+		return nil, fmt.Errorf("twitch user: %w", ErrNotFound)
 	}
 	return users[0], err
 }
 
+// MaxUsersPerRequest is the most users helix returns for one request.
+const MaxUsersPerRequest = 100
+
+// GetUsersByLogin retrieves the twitch users for the given logins. Without any
+// logins it returns the user the token belongs to.
 func (c *Client) GetUsersByLogin(ctx context.Context, login ...string) ([]*TwitchUser, error) {
-	u, err := url.Parse("https://api.twitch.tv/helix/users")
-	if err != nil {
-		return nil, err
-	}
+	return c.getUsers(ctx, "login", login)
+}
 
-	params := url.Values{
-		"login": login,
-	}
-	u.RawQuery = params.Encode()
+// GetUsersByID retrieves the twitch users for the given twitch userids
+func (c *Client) GetUsersByID(ctx context.Context, id ...string) ([]*TwitchUser, error) {
+	return c.getUsers(ctx, "id", id)
+}
 
-	r, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
-	if err != nil {
-		return nil, err
-	}
+// getUsers looks up users by key, splitting the values into requests of at
+// most MaxUsersPerRequest that run concurrently. Users are returned in the
+// order of the requests they came back in.
+func (c *Client) getUsers(ctx context.Context, key string, values []string) ([]*TwitchUser, error) {
+	chunks := chunk(dedupe(values), MaxUsersPerRequest)
 
-	resp, err := c.do(r)
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
 
-	var payload TwitchUserPayload
-	err = json.NewDecoder(resp.Body).Decode(&payload)
-	if err != nil {
-		return nil, err
+	var (
+		wg      sync.WaitGroup
+		results = make([][]*TwitchUser, len(chunks))
+		errs    = make([]error, len(chunks))
+	)
+	for i, values := range chunks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = c.getUsersPage(ctx, key, values)
+			if errs[i] != nil {
+				// No point finishing the rest
+				cancel()
+			}
+		}()
+	}
+	wg.Wait()
+
+	var users []*TwitchUser
+	for i, res := range results {
+		if errs[i] != nil {
+			return nil, errs[i]
+		}
+		users = append(users, res...)
 	}
-
-	if len(payload.Data) < 1 {
-		return nil, fmt.Errorf("no results")
+	if len(users) < 1 {
+		return nil, fmt.Errorf("no users found: %w", ErrNotFound)
 	}
-
-	return payload.Data, nil
+	return users, nil
 }
 
-// GetUsersByID retrieves the twitch users for the given twitch userids
-func (c *Client) GetUsersByID(ctx context.Context, id ...string) ([]*TwitchUser, error) {
-	u, err := url.Parse("https://api.twitch.tv/helix/users")
+func (c *Client) getUsersPage(ctx context.Context, key string, values []string) ([]*TwitchUser, error) {
+	u, err := url.Parse(c.HelixURL + "/users")
 	if err != nil {
 		return nil, err
 	}
 
 	params := url.Values{
-		"id": id,
+		key: values,
 	}
 	u.RawQuery = params.Encode()
 
@@ -317,9 +503,28 @@ func (c *Client) GetUsersByID(ctx context.Context, id ...string) ([]*TwitchUser,
 		return nil, err
 	}
 
-	if len(payload.Data) < 1 {
-		return nil, fmt.Errorf("no results")
+	return payload.Data, nil
+}
+
+// chunk splits values into slices of at most size. There's always at least
+// one, possibly empty, chunk.
+func chunk(values []string, size int) [][]string {
+	chunks := [][]string{}
+	for len(values) > size {
+		chunks = append(chunks, values[:size])
+		values = values[size:]
 	}
+	return append(chunks, values)
+}
 
-	return payload.Data, nil
+func dedupe(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	out := values[:0:0]
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	return out
 }
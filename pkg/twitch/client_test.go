@@ -0,0 +1,271 @@
+package twitch_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/cconger/pulse/pkg/twitch"
+	"github.com/cconger/pulse/pkg/twitch/twitchtest"
+)
+
+func newTestClient(t *testing.T) (*twitch.Client, *twitchtest.Server) {
+	t.Helper()
+	srv := twitchtest.NewServer("client-id", "client-secret")
+	t.Cleanup(srv.Close)
+
+	c, err := twitch.NewClient("client-id", "client-secret", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.HelixURL = srv.HelixURL()
+	c.OAuthURL = srv.OAuthURL()
+	return c, srv
+}
+
+func TestGetUsersBatches(t *testing.T) {
+	c, srv := newTestClient(t)
+
+	var logins []string
+	for i := 0; i < 250; i++ {
+		login := fmt.Sprintf("user%d", i)
+		srv.AddUser(twitchtest.User{ID: fmt.Sprint(i), Login: login, DisplayName: login})
+		logins = append(logins, login)
+	}
+	// Duplicates shouldn't cost another request
+	logins = append(logins, logins[:10]...)
+
+	users, err := c.GetUsersByLogin(context.Background(), logins...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 250 {
+		t.Errorf("expected 250 users, got %d", len(users))
+	}
+	if n := srv.Requests("/helix/users"); n != 3 {
+		t.Errorf("expected 3 helix requests, got %d", n)
+	}
+	if n := srv.Requests("/oauth2/token"); n != 1 {
+		t.Errorf("expected the app token to be fetched once, got %d", n)
+	}
+
+	users, err = c.GetUsersByID(context.Background(), "7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(users) != 1 || users[0].Login != "user7" {
+		t.Errorf("unexpected users %+v", users)
+	}
+
+	if _, err := c.GetUsersByLogin(context.Background(), "nobody"); !errors.Is(err, twitch.ErrNotFound) {
+		t.Errorf("expected not found for an unknown user, got %v", err)
+	}
+}
+
+func TestAppTokenExpiry(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+
+	// Close enough to expiry that every request renews it
+	srv.TokenTTL = 30 * time.Second
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetUsersByLogin(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if n := srv.Requests("/oauth2/token"); n != 2 {
+		t.Errorf("expected an expiring token to be renewed, got %d token requests", n)
+	}
+}
+
+func TestAppTokenRefreshOn401(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+
+	if _, err := c.GetUsersByLogin(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+	srv.ExpireTokens()
+	if _, err := c.GetUsersByLogin(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := srv.Requests("/oauth2/token"); n != 2 {
+		t.Errorf("expected the token to be refreshed once, got %d token requests", n)
+	}
+	if n := srv.Requests("/helix/users"); n != 3 {
+		t.Errorf("expected the rejected request to be retried once, got %d requests", n)
+	}
+}
+
+func TestUserTokenRefresh(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+
+	access, refresh := srv.UserToken("1")
+	var persisted [][2]string
+	ua := &twitch.UserAuth{
+		AccessToken:  access,
+		RefreshToken: refresh,
+	}
+	ua.OnRefresh = func(ctx context.Context, access, refresh string) {
+		// The callback can use the UserAuth it belongs to
+		if current, _ := ua.Token(ctx); current != access {
+			t.Errorf("expected the new token to be in place, got %q", current)
+		}
+		persisted = append(persisted, [2]string{access, refresh})
+	}
+	uc := c.UserClient(ua)
+
+	srv.ExpireTokens()
+	u, err := uc.GetUser(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Login != "alice" {
+		t.Errorf("unexpected user %+v", u)
+	}
+	if len(persisted) != 1 || persisted[0] != [2]string{ua.AccessToken, ua.RefreshToken} || ua.RefreshToken == refresh {
+		t.Errorf("expected the new token pair to be persisted, got %v", persisted)
+	}
+
+	// Without a working refresh token we give up instead of looping
+	srv.ExpireTokens()
+	srv.RevokeRefreshTokens()
+	if _, err := uc.GetUser(context.Background()); !errors.Is(err, twitch.ErrUnauthorized) {
+		t.Errorf("expected unauthorized once the refresh token is revoked, got %v", err)
+	}
+}
+
+func TestOAuthGetToken(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+
+	tok, err := c.OAuthGetToken(context.Background(), srv.AuthorizationCode("1"), "http://localhost/callback")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tok.AccessToken == "" || tok.RefreshToken == "" || tok.ExpiresIn != 3600 {
+		t.Errorf("unexpected token %+v", tok)
+	}
+
+	var apiErr *twitch.APIError
+	_, err = c.OAuthGetToken(context.Background(), "bogus", "http://localhost/callback")
+	if !errors.As(err, &apiErr) || apiErr.Message != "Invalid authorization code" {
+		t.Errorf("expected an invalid code to be rejected, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+
+	srv.FailNext(http.StatusInternalServerError, http.StatusTooManyRequests, http.StatusServiceUnavailable)
+	if _, err := c.GetUsersByLogin(context.Background(), "alice"); err != nil {
+		t.Fatalf("expected the request to be retried until it worked: %v", err)
+	}
+	if n := srv.Requests("/helix/users"); n != 4 {
+		t.Errorf("expected 4 attempts, got %d", n)
+	}
+
+	c.MaxRetries = 1
+	srv.FailNext(http.StatusBadGateway, http.StatusBadGateway)
+	var apiErr *twitch.APIError
+	_, err := c.GetUsersByLogin(context.Background(), "alice")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadGateway || !apiErr.Temporary() {
+		t.Errorf("expected the last 502 after running out of retries, got %v", err)
+	}
+	if n := srv.Requests("/helix/users"); n != 6 {
+		t.Errorf("expected 2 more attempts, got %d", n-4)
+	}
+
+	// Client errors aren't worth repeating
+	srv.FailNext(http.StatusBadRequest)
+	_, err = c.GetUsersByLogin(context.Background(), "alice")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest || apiErr.Message != "Bad Request" {
+		t.Errorf("expected a 400 with helix's message, got %v", err)
+	}
+	if errors.Is(err, twitch.ErrNotFound) || errors.Is(err, twitch.ErrUnauthorized) {
+		t.Errorf("a 400 shouldn't match the sentinels: %v", err)
+	}
+	if n := srv.Requests("/helix/users"); n != 7 {
+		t.Errorf("expected a 400 not to be retried, got %d attempts", n-6)
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+	srv.SetRateLimit(2, time.Minute)
+
+	if c.RateLimitRemaining() != -1 {
+		t.Errorf("expected an unknown rate limit before any request, got %d", c.RateLimitRemaining())
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetUsersByLogin(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if c.RateLimitRemaining() != 0 {
+		t.Errorf("expected the quota to be used up, got %d", c.RateLimitRemaining())
+	}
+
+	// The bucket won't refill in time, so fail without asking helix
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := c.GetUsersByLogin(ctx, "alice"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be exceeded, got %v", err)
+	}
+	if n := srv.Requests("/helix/users"); n != 2 {
+		t.Errorf("expected no request over the limit, got %d requests", n)
+	}
+}
+
+func TestRateLimitWaitsForReset(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the rate limit to reset")
+	}
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+	srv.SetRateLimit(1, time.Second)
+
+	start := time.Now()
+	for i := 0; i < 2; i++ {
+		if _, err := c.GetUsersByLogin(context.Background(), "alice"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if time.Since(start) < 500*time.Millisecond {
+		t.Error("expected the second request to wait for the reset")
+	}
+	if n := srv.Requests("/helix/users"); n != 2 {
+		t.Errorf("expected no 429s, got %d requests", n)
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	c, srv := newTestClient(t)
+	srv.AddUser(twitchtest.User{ID: "1", Login: "alice", DisplayName: "Alice"})
+	srv.SetRateLimit(1, time.Minute)
+	if _, err := c.GetUsersByLogin(context.Background(), "alice"); err != nil {
+		t.Fatal(err)
+	}
+
+	// A second client doesn't know the quota is spent, so helix rejects it
+	other, err := twitch.NewClient("client-id", "client-secret", srv.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	other.HelixURL = srv.HelixURL()
+	other.OAuthURL = srv.OAuthURL()
+	other.MaxRetries = 0
+
+	var apiErr *twitch.APIError
+	_, err = other.GetUsersByLogin(context.Background(), "alice")
+	if !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusTooManyRequests || apiErr.RetryAfter <= 0 {
+		t.Errorf("expected a 429 with a retry after, got %v", err)
+	}
+}
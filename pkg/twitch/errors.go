@@ -0,0 +1,89 @@
+package twitch
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	// ErrNotFound is returned when none of the requested resources exist.
+	ErrNotFound = errors.New("twitch: not found")
+	// ErrUnauthorized is returned when twitch rejects our credentials, even
+	// after refreshing them.
+	ErrUnauthorized = errors.New("twitch: unauthorized")
+	// ErrForbidden is returned when the token lacks a scope for the request.
+	ErrForbidden = errors.New("twitch: forbidden")
+)
+
+// APIError is an error response from helix or the oauth endpoints. It
+// matches ErrNotFound, ErrUnauthorized or ErrForbidden by status code.
+type APIError struct {
+	StatusCode int
+	// Message is the explanation twitch gave, if any.
+	Message string
+	// RetryAfter is how long until the request is worth repeating, zero if
+	// twitch didn't say.
+	RetryAfter time.Duration
+	Path       string
+}
+
+func (e *APIError) Error() string {
+	msg := fmt.Sprintf("twitch %s: %d %s", e.Path, e.StatusCode, http.StatusText(e.StatusCode))
+	if e.Message != "" {
+		msg += ": " + e.Message
+	}
+	return msg
+}
+
+func (e *APIError) Is(target error) bool {
+	switch target {
+	case ErrNotFound:
+		return e.StatusCode == http.StatusNotFound
+	case ErrUnauthorized:
+		return e.StatusCode == http.StatusUnauthorized
+	case ErrForbidden:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// Temporary reports whether the same request might succeed later.
+func (e *APIError) Temporary() bool {
+	return retryable(e.StatusCode)
+}
+
+// newAPIError builds an APIError from resp, consuming the body.
+func newAPIError(resp *http.Response) *APIError {
+	e := &APIError{
+		StatusCode: resp.StatusCode,
+		Path:       resp.Request.URL.Path,
+		RetryAfter: retryAfter(resp.Header),
+	}
+
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<16)).Decode(&body); err == nil {
+		e.Message = body.Message
+	}
+	return e
+}
+
+// retryAfter reads Retry-After, or failing that Ratelimit-Reset when the rate
+// limit is used up.
+func retryAfter(h http.Header) time.Duration {
+	if s, err := strconv.Atoi(h.Get("Retry-After")); err == nil && s > 0 {
+		return time.Duration(s) * time.Second
+	}
+	if h.Get("Ratelimit-Remaining") == "0" {
+		if reset, err := strconv.ParseInt(h.Get("Ratelimit-Reset"), 10, 64); err == nil {
+			return max(time.Until(time.Unix(reset, 0)), 0)
+		}
+	}
+	return 0
+}
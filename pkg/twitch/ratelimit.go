@@ -0,0 +1,119 @@
+package twitch
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket kept in step with the Ratelimit-* headers
+// helix sends on every response. Until the first response it lets everything
+// through.
+type rateLimiter struct {
+	mu        sync.Mutex
+	known     bool
+	limit     int
+	remaining int
+	reset     time.Time
+
+	now func() time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{now: time.Now}
+}
+
+// wait takes a token, blocking until the bucket refills if it's empty. It
+// fails straight away if ctx would expire before then.
+func (l *rateLimiter) wait(ctx context.Context) error {
+	for {
+		l.mu.Lock()
+		now := l.now()
+		if l.known && !now.Before(l.reset) {
+			// The bucket is full again, we'll hear the real count on the next
+			// response
+			l.remaining = l.limit
+		}
+		if !l.known || l.remaining > 0 {
+			l.remaining--
+			l.mu.Unlock()
+			return nil
+		}
+		delay := l.reset.Sub(now)
+		l.mu.Unlock()
+
+		if err := sleep(ctx, delay); err != nil {
+			return fmt.Errorf("waiting for helix rate limit: %w", err)
+		}
+	}
+}
+
+// update reseeds the bucket from a response.
+func (l *rateLimiter) update(h http.Header) {
+	limit, err1 := strconv.Atoi(h.Get("Ratelimit-Limit"))
+	remaining, err2 := strconv.Atoi(h.Get("Ratelimit-Remaining"))
+	reset, err3 := strconv.ParseInt(h.Get("Ratelimit-Reset"), 10, 64)
+	if err1 != nil || err2 != nil || err3 != nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.known = true
+	l.limit = limit
+	l.remaining = remaining
+	l.reset = time.Unix(reset, 0)
+}
+
+// Remaining is the number of requests left in the bucket, or -1 before helix
+// has told us.
+func (l *rateLimiter) Remaining() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !l.known {
+		return -1
+	}
+	if !l.now().Before(l.reset) {
+		return l.limit
+	}
+	return max(l.remaining, 0)
+}
+
+const (
+	retryBaseDelay = 250 * time.Millisecond
+	retryMaxDelay  = 10 * time.Second
+)
+
+// retryable reports whether a request that got status is worth repeating.
+func retryable(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// backoff is the jittered delay before retry number attempt, starting at 0.
+func backoff(attempt int) time.Duration {
+	d := min(retryBaseDelay<<attempt, retryMaxDelay)
+	// Somewhere in the upper half so concurrent retries spread out
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// sleep waits for d unless ctx ends first, or would end before d is up.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < d {
+		return context.DeadlineExceeded
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,66 @@
+package twitch
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func rateLimitHeaders(limit, remaining int, reset time.Time) http.Header {
+	h := http.Header{}
+	h.Set("Ratelimit-Limit", strconv.Itoa(limit))
+	h.Set("Ratelimit-Remaining", strconv.Itoa(remaining))
+	h.Set("Ratelimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+	return h
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	l := newRateLimiter()
+	l.now = func() time.Time { return now }
+
+	if l.Remaining() != -1 {
+		t.Errorf("expected unknown remaining before any response, got %d", l.Remaining())
+	}
+	if err := l.wait(context.Background()); err != nil {
+		t.Fatalf("expected requests to go through before any response: %v", err)
+	}
+
+	l.update(rateLimitHeaders(800, 2, now.Add(time.Minute)))
+	for i := 0; i < 2; i++ {
+		if err := l.wait(context.Background()); err != nil {
+			t.Fatalf("request %d: %v", i, err)
+		}
+	}
+	if l.Remaining() != 0 {
+		t.Errorf("expected the bucket to be empty, got %d", l.Remaining())
+	}
+
+	// The bucket won't refill before the deadline, so don't wait for it
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := l.wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the deadline to be respected, got %v", err)
+	}
+
+	now = now.Add(time.Minute)
+	if l.Remaining() != 800 {
+		t.Errorf("expected the bucket to refill after reset, got %d", l.Remaining())
+	}
+	if err := l.wait(context.Background()); err != nil {
+		t.Errorf("expected a request after reset to go through: %v", err)
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	for attempt := 0; attempt < 10; attempt++ {
+		d := backoff(attempt)
+		ceiling := min(retryBaseDelay<<attempt, retryMaxDelay)
+		if d < ceiling/2 || d > ceiling {
+			t.Errorf("attempt %d: backoff %s outside [%s, %s]", attempt, d, ceiling/2, ceiling)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+// Package twitchtest is a fake of the parts of helix and twitch oauth that
+// pulse uses, for testing without the network.
+package twitchtest
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type User struct {
+	ID          string `json:"id"`
+	Login       string `json:"login"`
+	DisplayName string `json:"display_name"`
+}
+
+type token struct {
+	userID  string // empty for app tokens
+	expires time.Time
+}
+
+// Server serves helix under /helix and oauth under /oauth2. Create it with
+// NewServer and point the client at HelixURL and OAuthURL.
+type Server struct {
+	*httptest.Server
+
+	ClientID     string
+	ClientSecret string
+	// TokenTTL is the expires_in handed out with new tokens.
+	TokenTTL time.Duration
+
+	mu            sync.Mutex
+	users         []User
+	tokens        map[string]token
+	refreshTokens map[string]string // refresh token to user id
+	codes         map[string]string // authorization code to user id
+	failures      []int
+	rateLimit     *rateLimit
+	requests      map[string]int
+}
+
+type rateLimit struct {
+	limit     int
+	remaining int
+	window    time.Duration
+	reset     time.Time
+}
+
+func NewServer(clientID, clientSecret string) *Server {
+	s := &Server{
+		ClientID:      clientID,
+		ClientSecret:  clientSecret,
+		TokenTTL:      time.Hour,
+		tokens:        make(map[string]token),
+		refreshTokens: make(map[string]string),
+		codes:         make(map[string]string),
+		requests:      make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /oauth2/token", s.handleToken)
+	mux.HandleFunc("GET /helix/users", s.helix(s.handleUsers))
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+func (s *Server) HelixURL() string { return s.URL + "/helix" }
+func (s *Server) OAuthURL() string { return s.URL + "/oauth2" }
+
+// AddUser makes a user known to helix.
+func (s *Server) AddUser(u User) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.users = append(s.users, u)
+}
+
+// UserToken issues a user access and refresh token pair for userID.
+func (s *Server) UserToken(userID string) (accessToken string, refreshToken string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.issueLocked(userID)
+}
+
+// AuthorizationCode issues a code that can be exchanged for a token of userID.
+func (s *Server) AuthorizationCode(userID string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	code := randomString()
+	s.codes[code] = userID
+	return code
+}
+
+// ExpireTokens invalidates every access token issued so far, refresh tokens
+// keep working.
+func (s *Server) ExpireTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.tokens)
+}
+
+// RevokeRefreshTokens invalidates every refresh token issued so far.
+func (s *Server) RevokeRefreshTokens() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	clear(s.refreshTokens)
+}
+
+// FailNext makes the next helix requests respond with the given statuses, in
+// order, instead of being served.
+func (s *Server) FailNext(statuses ...int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.failures = append(s.failures, statuses...)
+}
+
+// SetRateLimit allows limit helix requests per window. Responses carry the
+// Ratelimit-* headers and requests over the limit get a 429.
+func (s *Server) SetRateLimit(limit int, window time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rateLimit = &rateLimit{
+		limit:     limit,
+		remaining: limit,
+		window:    window,
+		reset:     ceilSecond(time.Now().Add(window)),
+	}
+}
+
+// Requests is how many requests were made to path, e.g. "/helix/users" or
+// "/oauth2/token", including failed ones.
+func (s *Server) Requests(path string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[path]
+}
+
+func (s *Server) issueLocked(userID string) (string, string) {
+	access, refresh := randomString(), randomString()
+	s.tokens[access] = token{userID: userID, expires: time.Now().Add(s.TokenTTL)}
+	if userID != "" {
+		s.refreshTokens[refresh] = userID
+	}
+	return access, refresh
+}
+
+type tokenResponse struct {
+	AccessToken  string   `json:"access_token"`
+	RefreshToken string   `json:"refresh_token,omitempty"`
+	ExpiresIn    int64    `json:"expires_in"`
+	Scope        []string `json:"scope"`
+	TokenType    string   `json:"token_type"`
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.requests[r.URL.Path]++
+
+	if err := r.ParseForm(); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	if r.PostForm.Get("client_id") != s.ClientID || r.PostForm.Get("client_secret") != s.ClientSecret {
+		writeError(w, http.StatusForbidden, "invalid client secret")
+		return
+	}
+
+	var userID string
+	switch r.PostForm.Get("grant_type") {
+	case "client_credentials":
+	case "refresh_token":
+		id, ok := s.refreshTokens[r.PostForm.Get("refresh_token")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Invalid refresh token")
+			return
+		}
+		// Refresh tokens are single use
+		delete(s.refreshTokens, r.PostForm.Get("refresh_token"))
+		userID = id
+	case "authorization_code":
+		id, ok := s.codes[r.PostForm.Get("code")]
+		if !ok {
+			writeError(w, http.StatusBadRequest, "Invalid authorization code")
+			return
+		}
+		delete(s.codes, r.PostForm.Get("code"))
+		userID = id
+	default:
+		writeError(w, http.StatusBadRequest, "unsupported grant type")
+		return
+	}
+
+	access, refresh := s.issueLocked(userID)
+	res := tokenResponse{
+		AccessToken: access,
+		ExpiresIn:   int64(s.TokenTTL / time.Second),
+		Scope:       []string{},
+		TokenType:   "bearer",
+	}
+	if userID != "" {
+		res.RefreshToken = refresh
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+// helix checks authentication, rate limits and injected failures before
+// calling h with the token's user id, empty for app tokens.
+func (s *Server) helix(h func(w http.ResponseWriter, r *http.Request, userID string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.requests[r.URL.Path]++
+
+		if rl := s.rateLimit; rl != nil {
+			now := time.Now()
+			if !now.Before(rl.reset) {
+				rl.remaining = rl.limit
+				rl.reset = ceilSecond(now.Add(rl.window))
+			}
+			limited := rl.remaining == 0
+			if !limited {
+				rl.remaining--
+			}
+			w.Header().Set("Ratelimit-Limit", strconv.Itoa(rl.limit))
+			w.Header().Set("Ratelimit-Remaining", strconv.Itoa(rl.remaining))
+			w.Header().Set("Ratelimit-Reset", strconv.FormatInt(rl.reset.Unix(), 10))
+			if limited {
+				s.mu.Unlock()
+				writeError(w, http.StatusTooManyRequests, "Too Many Requests")
+				return
+			}
+		}
+
+		if len(s.failures) > 0 {
+			status := s.failures[0]
+			s.failures = s.failures[1:]
+			s.mu.Unlock()
+			writeError(w, status, http.StatusText(status))
+			return
+		}
+
+		if r.Header.Get("Client-Id") != s.ClientID {
+			s.mu.Unlock()
+			writeError(w, http.StatusUnauthorized, "Client ID and OAuth token do not match")
+			return
+		}
+		bearer, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		tok, ok := s.tokens[bearer]
+		if !ok || time.Now().After(tok.expires) {
+			s.mu.Unlock()
+			writeError(w, http.StatusUnauthorized, "Invalid OAuth token")
+			return
+		}
+		s.mu.Unlock()
+
+		h(w, r, tok.userID)
+	}
+}
+
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request, userID string) {
+	q := r.URL.Query()
+	logins, ids := q["login"], q["id"]
+	if len(logins)+len(ids) > 100 {
+		writeError(w, http.StatusBadRequest, "The sum of the id and login parameters exceeds the maximum of 100")
+		return
+	}
+	if len(logins)+len(ids) == 0 {
+		if userID == "" {
+			writeError(w, http.StatusBadRequest, "Missing required parameter")
+			return
+		}
+		ids = []string{userID}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	data := []User{}
+	for _, u := range s.users {
+		for _, id := range ids {
+			if u.ID == id {
+				data = append(data, u)
+			}
+		}
+		for _, login := range logins {
+			if u.Login == login {
+				data = append(data, u)
+			}
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"data": data})
+}
+
+// helixError is the body helix sends with an error status.
+type helixError struct {
+	Error   string `json:"error"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, helixError{Error: http.StatusText(status), Status: status, Message: message})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// ceilSecond rounds up to a whole second, as Ratelimit-Reset can't say
+// anything finer.
+func ceilSecond(t time.Time) time.Time {
+	if r := t.Truncate(time.Second); r.Before(t) {
+		return r.Add(time.Second)
+	}
+	return t
+}
+
+func randomString() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}